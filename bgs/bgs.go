@@ -318,46 +318,21 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 	}
 	defer cancel()
 
-	header := events.EventHeader{Op: events.EvtKindMessage}
 	for {
 		select {
-		case evt := <-evts:
+		case evt, ok := <-evts:
+			if !ok {
+				// event manager shut down
+				return nil
+			}
+
 			wc, err := conn.NextWriter(websocket.BinaryMessage)
 			if err != nil {
 				return err
 			}
 
-			var obj lexutil.CBOR
-
-			switch {
-			case evt.Error != nil:
-				header.Op = events.EvtKindErrorFrame
-				obj = evt.Error
-			case evt.RepoCommit != nil:
-				header.MsgType = "#commit"
-				obj = evt.RepoCommit
-			case evt.RepoHandle != nil:
-				header.MsgType = "#handle"
-				obj = evt.RepoHandle
-			case evt.RepoInfo != nil:
-				header.MsgType = "#info"
-				obj = evt.RepoInfo
-			case evt.RepoMigrate != nil:
-				header.MsgType = "#migrate"
-				obj = evt.RepoMigrate
-			case evt.RepoTombstone != nil:
-				header.MsgType = "#tombstone"
-				obj = evt.RepoTombstone
-			default:
-				return fmt.Errorf("unrecognized event kind")
-			}
-
-			if err := header.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write header: %w", err)
-			}
-
-			if err := obj.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write event: %w", err)
+			if err := evt.MarshalFrames(wc); err != nil {
+				return err
 			}
 
 			if err := wc.Close(); err != nil {
@@ -24,6 +24,7 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 
 	logging "github.com/ipfs/go-log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/urfave/cli/v2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -179,8 +180,11 @@ func run(args []string) {
 		}
 
 		evtman := events.NewEventManager(dbp)
+		if err := evtman.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+			return fmt.Errorf("registering event manager metrics: %w", err)
+		}
 
-		go evtman.Run()
+		go evtman.Run(cctx.Context)
 
 		notifman := &notifs.NullNotifs{}
 
@@ -128,6 +128,10 @@ func evtOp(evt *events.XRPCStreamEvent) string {
 		return "#migrate"
 	case evt.RepoTombstone != nil:
 		return "#tombstone"
+	case evt.RepoIdentity != nil:
+		return events.MsgTypeIdentity
+	case evt.RepoAccount != nil:
+		return events.MsgTypeAccount
 	default:
 		return "unknown"
 	}
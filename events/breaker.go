@@ -0,0 +1,153 @@
+package events
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// BreakerState is the state of the persist circuit breaker; see
+// EventManagerOpts.PersistBreakerThreshold.
+type BreakerState int32
+
+const (
+	// BreakerClosed is normal operation.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen means persisting has been failing and the run loop has
+	// stopped accepting operations until the cooldown passes.
+	BreakerOpen
+
+	// BreakerHalfOpen means the cooldown has passed and the next persist
+	// decides whether the breaker closes or opens again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultPersistRetryBackoff = 100 * time.Millisecond
+	maxPersistRetryBackoff     = 10 * time.Second
+	defaultBreakerCooldown     = 10 * time.Second
+)
+
+// persistBreaker tracks consecutive persist failures. Everything but state is
+// owned by the run loop.
+type persistBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	timer    *time.Timer
+	state    atomic.Int32
+}
+
+func (b *persistBreaker) get() BreakerState {
+	return BreakerState(b.state.Load())
+}
+
+// resumeC fires when an open breaker's cooldown is over, and is nil
+// otherwise.
+func (b *persistBreaker) resumeC() <-chan time.Time {
+	if b.get() != BreakerOpen {
+		return nil
+	}
+	return b.timer.C
+}
+
+// PersistBreakerState returns the current state of the persist circuit
+// breaker, which is always BreakerClosed unless PersistBreakerThreshold is
+// set.
+func (em *EventManager) PersistBreakerState() BreakerState {
+	return em.breaker.get()
+}
+
+func (em *EventManager) setBreakerState(s BreakerState) {
+	em.breaker.state.Store(int32(s))
+	em.metrics.breakerState.Set(float64(s))
+}
+
+// recordPersist feeds the outcome of a persist, retries included, to the
+// breaker.
+func (em *EventManager) recordPersist(err error) {
+	b := em.breaker
+	if b.threshold <= 0 {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		if b.get() != BreakerClosed {
+			em.log.Infow("persister recovered, closing circuit breaker")
+			em.setBreakerState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.get() == BreakerHalfOpen || b.failures >= b.threshold {
+		em.log.Warnw("persister is failing, opening circuit breaker", "err", err, "failures", b.failures, "cooldown", b.cooldown)
+		if b.timer == nil {
+			b.timer = time.NewTimer(b.cooldown)
+		} else {
+			resetTimer(b.timer, b.cooldown)
+		}
+		em.setBreakerState(BreakerOpen)
+	}
+}
+
+// halfOpenBreaker lets operations through again once the cooldown is over.
+func (em *EventManager) halfOpenBreaker() {
+	em.log.Infow("circuit breaker cooldown over, retrying persister")
+	em.setBreakerState(BreakerHalfOpen)
+}
+
+// retryable reports whether a failed persist may be tried again. A *TeeError
+// means the primary already stored the event and only a mirror failed, so
+// another attempt would store it twice.
+func retryable(err error) bool {
+	var terr *TeeError
+	return !errors.As(err, &terr)
+}
+
+// persistWithRetry calls persist until it succeeds, it has been retried
+// PersistRetries times, or the manager shuts down, backing off between
+// attempts, and records the outcome with the breaker. persist reports
+// whether a failure is safe to retry.
+func (em *EventManager) persistWithRetry(persist func() (retry bool, err error)) error {
+	backoff := em.persistRetryBackoff
+	retry, err := persist()
+	for i := 0; err != nil && retry && i < em.persistRetries; i++ {
+		em.log.Warnw("failed to persist, retrying", "err", err, "attempt", i+1, "backoff", backoff)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-em.closed:
+			t.Stop()
+			em.recordPersist(err)
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxPersistRetryBackoff {
+			backoff = maxPersistRetryBackoff
+		}
+
+		retry, err = persist()
+	}
+
+	em.recordPersist(err)
+	return err
+}
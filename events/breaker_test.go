@@ -0,0 +1,273 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+// failingPersister fails Persist while failing is set, recording when each
+// attempt was made.
+type failingPersister struct {
+	*MemPersister
+
+	lk       sync.Mutex
+	failing  bool
+	attempts []time.Time
+}
+
+var errStubPersist = errors.New("stub persister failure")
+
+func newFailingPersister() *failingPersister {
+	return &failingPersister{MemPersister: NewMemPersister(), failing: true}
+}
+
+func (p *failingPersister) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	p.lk.Lock()
+	p.attempts = append(p.attempts, time.Now())
+	failing := p.failing
+	p.lk.Unlock()
+
+	if failing {
+		return 0, errStubPersist
+	}
+	return p.MemPersister.Persist(ctx, e)
+}
+
+func (p *failingPersister) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return persistEach(ctx, p, es)
+}
+
+func (p *failingPersister) setFailing(failing bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.failing = failing
+}
+
+func (p *failingPersister) attemptTimes() []time.Time {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return append([]time.Time(nil), p.attempts...)
+}
+
+func breakerEvent() *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Did:    "did:plc:breaker",
+			Handle: "test.example.com",
+		},
+	}
+}
+
+func TestPersistRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const (
+		retries = 3
+		backoff = 20 * time.Millisecond
+	)
+
+	p := newFailingPersister()
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:           true,
+		PersistRetries:      retries,
+		PersistRetryBackoff: backoff,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	err := em.AddEventSync(ctx, breakerEvent())
+	if !errors.Is(err, errStubPersist) {
+		t.Fatalf("expected the persister's error once the retries ran out, got %v", err)
+	}
+
+	attempts := p.attemptTimes()
+	if len(attempts) != retries+1 {
+		t.Fatalf("expected %d attempts, got %d", retries+1, len(attempts))
+	}
+
+	// each retry waits twice as long as the one before
+	wait := backoff
+	for i := 1; i < len(attempts); i++ {
+		if gap := attempts[i].Sub(attempts[i-1]); gap < wait {
+			t.Fatalf("retry %d came %s after the previous attempt, expected at least %s", i, gap, wait)
+		}
+		wait *= 2
+	}
+
+	// a persist that recovers partway through the retries succeeds
+	go func() {
+		time.Sleep(backoff / 2)
+		p.setFailing(false)
+	}()
+	if err := em.AddEventSync(ctx, breakerEvent()); err != nil {
+		t.Fatalf("expected the event to persist on a retry, got %v", err)
+	}
+	if n := len(p.attemptTimes()) - len(attempts); n != 2 {
+		t.Fatalf("expected 2 attempts for the recovering persist, got %d", n)
+	}
+	if em.PersistBreakerState() != BreakerClosed {
+		t.Fatalf("expected the breaker to stay closed without a threshold, got %s", em.PersistBreakerState())
+	}
+}
+
+func TestPersistBreaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const (
+		threshold = 3
+		cooldown  = 200 * time.Millisecond
+	)
+
+	p := newFailingPersister()
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:               true,
+		PersistBreakerThreshold: threshold,
+		PersistBreakerCooldown:  cooldown,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	expectState := func(want BreakerState) {
+		t.Helper()
+		if got := em.PersistBreakerState(); got != want {
+			t.Fatalf("expected the breaker to be %s, got %s", want, got)
+		}
+	}
+
+	for i := 0; i < threshold; i++ {
+		expectState(BreakerClosed)
+		if err := em.AddEventSync(ctx, breakerEvent()); err == nil {
+			t.Fatalf("expected persist %d to fail", i)
+		}
+	}
+	expectState(BreakerOpen)
+
+	// while open, the run loop doesn't take the next event at all
+	addAsync := func() <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- em.AddEventSync(ctx, breakerEvent()) }()
+		return done
+	}
+
+	done := addAsync()
+
+	// but control operations still go through: a consumer can subscribe,
+	// change its filter and disconnect, and stats can be read
+	ctl, cctl := context.WithTimeout(ctx, cooldown/4)
+	sub, err := em.SubscribeHandle(ctl, func(*XRPCStreamEvent) bool { return true }, nil, nil)
+	if err != nil {
+		t.Fatalf("subscribing with the breaker open: %v", err)
+	}
+	if err := sub.UpdateFilter(ctl, nil); err != nil {
+		t.Fatalf("updating a filter with the breaker open: %v", err)
+	}
+	if n, err := em.SubscriberCount(ctl); err != nil || n != 1 {
+		t.Fatalf("expected to count 1 subscriber with the breaker open, got %d (%v)", n, err)
+	}
+	sub.Close()
+	if n, err := em.SubscriberCount(ctl); err != nil || n != 0 {
+		t.Fatalf("expected the closed subscription to be removed with the breaker open, got %d subscribers (%v)", n, err)
+	}
+	cctl()
+
+	time.Sleep(cooldown / 2)
+	if n := len(p.attemptTimes()); n != threshold {
+		t.Fatalf("expected no persist attempts while the breaker is open, got %d", n-threshold)
+	}
+	expectState(BreakerOpen)
+
+	// after the cooldown the event is let through, and failing while half
+	// open opens the breaker for another cooldown
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the persist let through half open to fail")
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the breaker to half open")
+	}
+	attempts := p.attemptTimes()
+	if len(attempts) != threshold+1 {
+		t.Fatalf("expected one persist attempt once half open, got %d", len(attempts)-threshold)
+	}
+	if waited := attempts[threshold].Sub(attempts[threshold-1]); waited < cooldown {
+		t.Fatalf("breaker let a persist through %s after opening, expected at least %s", waited, cooldown)
+	}
+	expectState(BreakerOpen)
+
+	// once the persister recovers, the next persist let through closes it
+	p.setFailing(false)
+	select {
+	case err := <-addAsync():
+		if err != nil {
+			t.Fatalf("expected the persist let through half open to succeed, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the breaker to half open again")
+	}
+	expectState(BreakerClosed)
+
+	if err := em.AddEventSync(ctx, breakerEvent()); err != nil {
+		t.Fatalf("expected persists to go through with the breaker closed, got %v", err)
+	}
+}
+
+// TestPersistRetriesTee checks that an event a tee's primary stored is not
+// persisted again when only a mirror failed.
+func TestPersistRetriesTee(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	primary := NewMemPersister()
+	mirror := newFailingPersister()
+	em := NewEventManagerWithOpts(NewTeePersistence(primary, mirror), &EventManagerOpts{
+		PersistRetries:      2,
+		PersistRetryBackoff: time.Millisecond,
+		AtomicBatches:       true,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	sub, err := em.SubscribeHandle(ctx, func(*XRPCStreamEvent) bool { return true }, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var terr *TeeError
+	if err := em.AddEventSync(ctx, breakerEvent()); !errors.As(err, &terr) {
+		t.Fatalf("expected the mirror's failure as a *TeeError, got %v", err)
+	}
+	if err := em.AddEvents(ctx, []*XRPCStreamEvent{breakerEvent(), breakerEvent()}); !errors.As(err, &terr) {
+		t.Fatalf("expected the mirror's batch failure as a *TeeError, got %v", err)
+	}
+
+	if n := len(mirror.attemptTimes()); n != 2 {
+		t.Fatalf("expected the mirror to be tried once for the event and once for the batch, got %d attempts", n)
+	}
+
+	var stored []int64
+	if err := primary.Playback(ctx, 0, func(e *XRPCStreamEvent) error {
+		stored = append(stored, e.sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, stored, 1, 3)
+
+	// the event goes out under the seq it was stored with, while the batch
+	// is discarded, and the next event follows it
+	mirror.setFailing(false)
+	if err := em.AddEventSync(ctx, breakerEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if got := takeSeqs(t, ctx, sub, 2); got[0] != 1 || got[1] != 4 {
+		t.Fatalf("expected seqs 1 and 4 to be broadcast, got %v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+// labelCoalescer holds label batches that have been persisted but not yet
+// broadcast, so a burst of small batches can be sent to subscribers as one.
+// It is owned by the run loop.
+type labelCoalescer struct {
+	window  time.Duration
+	pending []*XRPCStreamEvent
+	timer   *time.Timer
+}
+
+// flushC fires when the pending batches have waited out the window. It is nil
+// while nothing is pending.
+func (lc *labelCoalescer) flushC() <-chan time.Time {
+	if lc == nil || lc.timer == nil {
+		return nil
+	}
+	return lc.timer.C
+}
+
+// add queues a label batch. The caller must already have flushed if evt
+// doesn't directly follow the pending batches.
+func (lc *labelCoalescer) add(evt *XRPCStreamEvent) {
+	if len(lc.pending) == 0 {
+		lc.timer = time.NewTimer(lc.window)
+	}
+	lc.pending = append(lc.pending, evt)
+}
+
+// take returns the pending batches merged into a single batch carrying the
+// seq of the last one, or nil if nothing is pending. The events themselves
+// are left untouched since the persister may still hold them, and the merged
+// batch keeps them for subscribers still catching up, whose playback may
+// already have sent some of them.
+func (lc *labelCoalescer) take() *XRPCStreamEvent {
+	if lc == nil || len(lc.pending) == 0 {
+		return nil
+	}
+
+	lc.timer.Stop()
+	lc.timer = nil
+
+	pending := lc.pending
+	lc.pending = nil
+	if len(pending) == 1 {
+		return pending[0]
+	}
+
+	var n int
+	for _, evt := range pending {
+		n += len(evt.LabelLabels.Labels)
+	}
+
+	last := pending[len(pending)-1].LabelLabels
+	merged := &label.SubscribeLabels_Labels{
+		LexiconTypeID: last.LexiconTypeID,
+		Seq:           last.Seq,
+		Labels:        make([]*label.Label, 0, n),
+	}
+	for _, evt := range pending {
+		merged.Labels = append(merged.Labels, evt.LabelLabels.Labels...)
+	}
+
+	return &XRPCStreamEvent{LabelLabels: merged, coalesced: pending}
+}
+
+// flushLabels broadcasts any label batches held for coalescing.
+func (em *EventManager) flushLabels() {
+	if merged := em.labels.take(); merged != nil {
+		em.broadcast(merged)
+	}
+}
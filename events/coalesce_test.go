@@ -0,0 +1,188 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+func labelBatch(val string) *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		LabelLabels: &label.SubscribeLabels_Labels{
+			LexiconTypeID: "com.atproto.label.subscribeLabels#labels",
+			Labels: []*label.Label{{
+				Src: "did:plc:labeler",
+				Uri: "at://did:plc:alice/app.bsky.feed.post/1",
+				Val: val,
+				Cts: "2024-01-01T00:00:00Z",
+			}},
+		},
+	}
+}
+
+// labelVals flattens the label values of evts, with "-" for other events.
+func labelVals(evts []*XRPCStreamEvent) []string {
+	var vals []string
+	for _, e := range evts {
+		if e.LabelLabels == nil {
+			vals = append(vals, "-")
+			continue
+		}
+		for _, l := range e.LabelLabels.Labels {
+			vals = append(vals, l.Val)
+		}
+	}
+	return vals
+}
+
+func takeEvents(t *testing.T, ctx context.Context, sub *Subscription, n int) []*XRPCStreamEvent {
+	t.Helper()
+
+	var evts []*XRPCStreamEvent
+	for len(evts) < n {
+		select {
+		case e := <-sub.Events():
+			evts = append(evts, e)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %d events, got %v", n, labelVals(evts))
+		}
+	}
+
+	select {
+	case e := <-sub.Events():
+		t.Fatalf("expected only %v, also got %v", labelVals(evts), labelVals([]*XRPCStreamEvent{e}))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	return evts
+}
+
+func TestLabelCoalescing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:           true,
+		LabelCoalesceWindow: 50 * time.Millisecond,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	sub, err := em.SubscribeHandle(ctx, func(*XRPCStreamEvent) bool { return true }, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := em.AddEventSync(ctx, labelBatch(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evts := takeEvents(t, ctx, sub, 1)
+	merged := evts[0].LabelLabels
+	if got := labelVals(evts); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("expected a single batch of a, b and c, got %v", got)
+	}
+	if merged.Seq != 3 {
+		t.Fatalf("expected the merged batch to carry the last seq 3, got %d", merged.Seq)
+	}
+	if merged.LexiconTypeID != "com.atproto.label.subscribeLabels#labels" {
+		t.Fatalf("expected the merged batch to keep its $type, got %q", merged.LexiconTypeID)
+	}
+}
+
+// pausedPlayback stops the first playback once it has sent the events up to
+// upTo, holding it there until release is closed, as if the persister hadn't
+// had the rest yet when playback read it.
+type pausedPlayback struct {
+	*MemPersister
+	upTo    int64
+	paused  chan struct{}
+	release chan struct{}
+	played  atomic.Bool
+}
+
+var errPlaybackPaused = errors.New("playback paused")
+
+func (p *pausedPlayback) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	if p.played.Swap(true) {
+		return p.MemPersister.Playback(ctx, since, cb)
+	}
+
+	err := p.MemPersister.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if e.sequence() > p.upTo {
+			return errPlaybackPaused
+		}
+		return cb(e)
+	})
+	if err != nil && !errors.Is(err, errPlaybackPaused) {
+		return err
+	}
+
+	close(p.paused)
+	<-p.release
+	return nil
+}
+
+// TestLabelCoalescingDuringCatchUp has a coalesced batch reach a subscriber
+// whose playback already sent part of it.
+func TestLabelCoalescingDuringCatchUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := &pausedPlayback{
+		MemPersister: NewMemPersister(),
+		upTo:         1,
+		paused:       make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:           true,
+		LabelCoalesceWindow: time.Hour,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	// both batches are persisted and held for coalescing
+	for _, v := range []string{"a", "b"} {
+		if err := em.AddEventSync(ctx, labelBatch(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := int64(0)
+	sub, err := em.SubscribeHandle(ctx, func(*XRPCStreamEvent) bool { return true }, &since, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.paused:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for playback")
+	}
+
+	// with playback past a but not b, a repo event flushes the merged batch
+	// to the subscriber while it is still catching up
+	if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:alice", Handle: "alice.test"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	close(p.release)
+
+	evts := takeEvents(t, ctx, sub, 3)
+	if got := labelVals(evts); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "-" {
+		t.Fatalf("expected a, b and then the repo event exactly once each, got %v", got)
+	}
+	for i, e := range evts {
+		if seq := e.sequence(); seq != int64(i+1) {
+			t.Fatalf("expected event %d to have seq %d, got %d", i, i+1, seq)
+		}
+	}
+}
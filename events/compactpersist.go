@@ -0,0 +1,174 @@
+package events
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// CompactingPersistence is an in-memory persister for consumers that want
+// current state rather than history. For each account it keeps only the most
+// recent commit, and the most recent handle, identity, account and migrate
+// events, overwriting older ones as new events arrive. A tombstone replaces
+// everything held for the account, until a later commit brings it back.
+// Events not about an account, such as label batches, are not kept.
+//
+// Playback yields the surviving events in seq order, at most one of each
+// kind per account. Cursors keep working, since everything after a cursor
+// that is still current is played back, but the full history is gone: a
+// consumer replaying from the start sees the state of each repo, not how it
+// got there.
+type CompactingPersistence struct {
+	lk  sync.Mutex
+	seq int64
+
+	// first is the seq of the first event ever persisted
+	first int64
+
+	// events holds the retained events in seq order, and byDID points to
+	// each of them by account and then kind
+	events *list.List
+	byDID  map[string]map[string]*list.Element
+}
+
+func NewCompactingPersistence() *CompactingPersistence {
+	return &CompactingPersistence{
+		events: list.New(),
+		byDID:  make(map[string]map[string]*list.Element),
+	}
+}
+
+func (p *CompactingPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	did := e.repoDID()
+	if did == "" {
+		return e.sequence(), nil
+	}
+
+	p.seq = memNextSeq(p.seq, e)
+	if p.first == 0 {
+		p.first = p.seq
+	}
+
+	switch {
+	case e.RepoTombstone != nil:
+		for _, el := range p.byDID[did] {
+			p.events.Remove(el)
+		}
+		delete(p.byDID, did)
+	case e.RepoCommit != nil:
+		p.remove(did, "tombstone")
+	}
+
+	kind := e.kind()
+	p.remove(did, kind)
+	kinds := p.byDID[did]
+	if kinds == nil {
+		kinds = make(map[string]*list.Element)
+		p.byDID[did] = kinds
+	}
+	kinds[kind] = p.events.PushBack(e)
+
+	return p.seq, nil
+}
+
+// remove drops the event of the given kind held for did, if any. The caller
+// must hold lk.
+func (p *CompactingPersistence) remove(did, kind string) {
+	kinds := p.byDID[did]
+	el, ok := kinds[kind]
+	if !ok {
+		return
+	}
+
+	p.events.Remove(el)
+	delete(kinds, kind)
+	if len(kinds) == 0 {
+		delete(p.byDID, did)
+	}
+}
+
+func (p *CompactingPersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return persistEach(ctx, p, es)
+}
+
+func (p *CompactingPersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	return &nonTxBatch{p}, nil
+}
+
+// retained returns the retained events with seqs after since, in order.
+func (p *CompactingPersistence) retained(since int64) []*XRPCStreamEvent {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	// the list is in seq order, so walk back from the newest event to the
+	// cursor
+	var out []*XRPCStreamEvent
+	for el := p.events.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*XRPCStreamEvent)
+		if e.sequence() <= since {
+			break
+		}
+		out = append(out, e)
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return out
+}
+
+func (p *CompactingPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	for _, e := range p.retained(since) {
+		if err := cb(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *CompactingPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return playbackByDIDScan(ctx, p, did, since, cb)
+}
+
+func (p *CompactingPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return playbackByTimeScan(ctx, p, from, to, cb)
+}
+
+func (p *CompactingPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	for did, kinds := range p.byDID {
+		for kind, el := range kinds {
+			if el.Value.(*XRPCStreamEvent).PrivUid == usr {
+				p.remove(did, kind)
+			}
+		}
+	}
+
+	return nil
+}
+
+// EarliestSeq returns the seq of the first event ever persisted rather than
+// of the oldest one retained: compaction only drops events that have been
+// superseded, so playing back from before any retained event still yields the
+// complete current state and the cursor isn't outdated.
+func (p *CompactingPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.first, nil
+}
+
+func (p *CompactingPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.seq, nil
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+// compactSeqs plays back everything in p after since.
+func compactSeqs(t *testing.T, p *CompactingPersistence, since int64) []int64 {
+	var seqs []int64
+	if err := p.Playback(context.Background(), since, func(e *XRPCStreamEvent) error {
+		seqs = append(seqs, e.sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	p := NewCompactingPersistence()
+
+	commit := func(did string) *XRPCStreamEvent {
+		return &XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{Repo: did}}
+	}
+	handle := func(did string) *XRPCStreamEvent {
+		return &XRPCStreamEvent{RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: did, Handle: "test.example.com"}}
+	}
+	tombstone := func(did string) *XRPCStreamEvent {
+		return &XRPCStreamEvent{RepoTombstone: &comatproto.SyncSubscribeRepos_Tombstone{Did: did}}
+	}
+
+	for _, e := range []*XRPCStreamEvent{
+		commit("did:plc:alice"),  // 1
+		handle("did:plc:alice"),  // 2
+		commit("did:plc:bob"),    // 3
+		commit("did:plc:alice"),  // 4, supersedes 1
+		handle("did:plc:alice"),  // 5, supersedes 2
+		tombstone("did:plc:bob"), // 6, replaces 3
+	} {
+		if _, err := p.Persist(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := compactSeqs(t, p, 0); len(got) != 3 || got[0] != 4 || got[1] != 5 || got[2] != 6 {
+		t.Fatalf("expected seqs 4, 5 and the tombstone 6, got %v", got)
+	}
+
+	// a later commit brings the account back without its tombstone
+	if _, err := p.Persist(ctx, commit("did:plc:bob")); err != nil {
+		t.Fatal(err)
+	}
+	if got := compactSeqs(t, p, 0); len(got) != 3 || got[0] != 4 || got[1] != 5 || got[2] != 7 {
+		t.Fatalf("expected seqs 4, 5 and 7, got %v", got)
+	}
+
+	// cursors still pick up from where they left off
+	if got := compactSeqs(t, p, 4); len(got) != 2 || got[0] != 5 || got[1] != 7 {
+		t.Fatalf("expected seqs 5 and 7 after cursor 4, got %v", got)
+	}
+	if got := compactSeqs(t, p, 7); len(got) != 0 {
+		t.Fatalf("expected nothing after the latest seq, got %v", got)
+	}
+
+	if seq, err := p.EarliestSeq(ctx); err != nil || seq != 1 {
+		t.Fatalf("expected earliest seq 1, got %d (%v)", seq, err)
+	}
+	if seq, err := p.LatestSeq(ctx); err != nil || seq != 7 {
+		t.Fatalf("expected latest seq 7, got %d (%v)", seq, err)
+	}
+}
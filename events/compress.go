@@ -0,0 +1,88 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Commit Blocks can be large, so subscribers and persisters may opt into
+// carrying them zstd compressed: see SubscribeOpts.CompressBlocks and
+// SQLiteOpts.CompressBlocks. Only the Blocks field is compressed, so the rest
+// of the frame can still be decoded as usual.
+
+// the encoder and decoder are safe for concurrent use with EncodeAll and
+// DecodeAll
+var (
+	blocksEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	blocksDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// CompressBlocks returns the zstd compressed form of a commit's Blocks.
+func CompressBlocks(blocks []byte) []byte {
+	return blocksEncoder.EncodeAll(blocks, make([]byte, 0, len(blocks)/2))
+}
+
+// DecompressBlocks reverses CompressBlocks, for consumers that subscribed
+// with compressed blocks.
+func DecompressBlocks(compressed []byte) ([]byte, error) {
+	blocks, err := blocksDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing blocks: %w", err)
+	}
+
+	return blocks, nil
+}
+
+// hasBlocks reports whether evt is a commit with Blocks to compress.
+func (evt *XRPCStreamEvent) hasBlocks() bool {
+	return evt.RepoCommit != nil && len(evt.RepoCommit.Blocks) > 0
+}
+
+// withBlocks returns a copy of a commit event with its Blocks replaced,
+// leaving evt, which may be shared, untouched.
+func (evt *XRPCStreamEvent) withBlocks(blocks []byte) *XRPCStreamEvent {
+	commit := *evt.RepoCommit
+	commit.Blocks = blocks
+
+	out := *evt
+	out.RepoCommit = &commit
+	return &out
+}
+
+// compressBlocks returns a copy of a commit event with its Blocks compressed,
+// recording the sizes before and after.
+func (em *EventManager) compressBlocks(evt *XRPCStreamEvent) *XRPCStreamEvent {
+	compressed := CompressBlocks(evt.RepoCommit.Blocks)
+	em.metrics.blocksBytes.WithLabelValues("raw").Add(float64(len(evt.RepoCommit.Blocks)))
+	em.metrics.blocksBytes.WithLabelValues("zstd").Add(float64(len(compressed)))
+
+	return evt.withBlocks(compressed)
+}
+
+// prepare applies the subscriber's transform and, if it asked for them,
+// compressed blocks to evt, returning nil if the transform skips it. If
+// shared is non-nil it caches evt's compressed form, so a broadcast only
+// compresses an event once however many subscribers want it that way.
+func (em *EventManager) prepare(s *Subscriber, evt *XRPCStreamEvent, shared **XRPCStreamEvent) *XRPCStreamEvent {
+	out := evt
+	if s.transform != nil {
+		if out = s.callTransform(evt); out == nil {
+			return nil
+		}
+	}
+
+	if !s.compressBlocks || !out.hasBlocks() {
+		return out
+	}
+
+	// transformed events are the subscriber's own
+	if out != evt || shared == nil {
+		return em.compressBlocks(out)
+	}
+
+	if *shared == nil {
+		*shared = em.compressBlocks(evt)
+	}
+	return *shared
+}
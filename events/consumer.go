@@ -17,6 +17,8 @@ type RepoStreamCallbacks struct {
 	RepoInfo      func(evt *comatproto.SyncSubscribeRepos_Info) error
 	RepoMigrate   func(evt *comatproto.SyncSubscribeRepos_Migrate) error
 	RepoTombstone func(evt *comatproto.SyncSubscribeRepos_Tombstone) error
+	RepoIdentity  func(evt *IdentityEvent) error
+	RepoAccount   func(evt *AccountEvent) error
 	LabelLabels   func(evt *label.SubscribeLabels_Labels) error
 	LabelInfo     func(evt *label.SubscribeLabels_Info) error
 	Error         func(evt *ErrorFrame) error
@@ -128,6 +130,28 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, cbs *RepoStreamC
 						return err
 					}
 				}
+			case MsgTypeIdentity:
+				var evt IdentityEvent
+				if err := evt.UnmarshalCBOR(r); err != nil {
+					return err
+				}
+
+				if cbs.RepoIdentity != nil {
+					if err := cbs.RepoIdentity(&evt); err != nil {
+						return err
+					}
+				}
+			case MsgTypeAccount:
+				var evt AccountEvent
+				if err := evt.UnmarshalCBOR(r); err != nil {
+					return err
+				}
+
+				if cbs.RepoAccount != nil {
+					if err := cbs.RepoAccount(&evt); err != nil {
+						return err
+					}
+				}
 			case "#labebatch":
 				var evt label.SubscribeLabels_Labels
 				if err := evt.UnmarshalCBOR(r); err != nil {
@@ -147,6 +171,9 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, cbs *RepoStreamC
 				} else {
 					log.Warnf("received label event with nil append object (seq %d)", evt.Seq)
 				}
+			default:
+				// newer kinds are skipped, see FrameVersion
+				log.Debugf("skipping unknown event type %q (version %d)", header.MsgType, header.Version)
 			}
 
 		case EvtKindErrorFrame:
@@ -161,7 +188,7 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, cbs *RepoStreamC
 				}
 			}
 		default:
-			return fmt.Errorf("unrecognized event stream type: %d", header.Op)
+			log.Debugf("skipping unknown event stream type %d (version %d)", header.Op, header.Version)
 		}
 
 	}
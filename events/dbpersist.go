@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -15,12 +16,23 @@ import (
 
 	cid "github.com/ipfs/go-cid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DbPersistence struct {
 	db *gorm.DB
 
 	cs *carstore.CarStore
+
+	persistRouting bool
+}
+
+// DbPersistenceOpts holds optional DbPersistence settings.
+type DbPersistenceOpts struct {
+	// PersistRouting stores each event's PrivPdsId and PrivRelevantPds with
+	// it and restores them, along with PrivUid, on playback, so replayed
+	// events route to subscribers the same way live ones do.
+	PersistRouting bool
 }
 
 type RepoEventRecord struct {
@@ -28,11 +40,16 @@ type RepoEventRecord struct {
 	Commit util.DbCID
 	Prev   *util.DbCID
 
-	Time  time.Time
+	Time  time.Time `gorm:"index"`
 	Blobs []byte
-	Repo  util.Uid
+	Repo  util.Uid `gorm:"index"`
 	Event string
 
+	// PdsId and RelevantPds hold the event's routing fields, if the
+	// persister was configured to keep them
+	PdsId       uint
+	RelevantPds []byte
+
 	Ops []RepoOpRecord
 }
 
@@ -45,6 +62,14 @@ type RepoOpRecord struct {
 }
 
 func NewDbPersistence(db *gorm.DB, cs *carstore.CarStore) (*DbPersistence, error) {
+	return NewDbPersistenceWithOpts(db, cs, nil)
+}
+
+func NewDbPersistenceWithOpts(db *gorm.DB, cs *carstore.CarStore, opts *DbPersistenceOpts) (*DbPersistence, error) {
+	if opts == nil {
+		opts = &DbPersistenceOpts{}
+	}
+
 	if err := db.AutoMigrate(&RepoEventRecord{}); err != nil {
 		return nil, err
 	}
@@ -54,14 +79,21 @@ func NewDbPersistence(db *gorm.DB, cs *carstore.CarStore) (*DbPersistence, error
 	}
 
 	return &DbPersistence{
-		db: db,
-		cs: cs,
+		db:             db,
+		cs:             cs,
+		persistRouting: opts.PersistRouting,
 	}, nil
 }
 
-func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+// Persist stores commit events, letting the database assign the seq unless
+// the manager already did. Other events aren't stored.
+func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	return p.persist(ctx, p.db, e)
+}
+
+func (p *DbPersistence) persist(ctx context.Context, db *gorm.DB, e *XRPCStreamEvent) (int64, error) {
 	if e.RepoCommit == nil {
-		return nil
+		return e.sequence(), nil
 	}
 
 	evt := e.RepoCommit
@@ -74,7 +106,7 @@ func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 
 	uid, err := p.uidForDid(ctx, evt.Repo)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	var prev *util.DbCID
@@ -86,17 +118,20 @@ func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 	if len(evt.Blobs) > 0 {
 		b, err := json.Marshal(evt.Blobs)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		blobs = b
 	}
 
 	t, err := time.Parse(util.ISO8601, evt.Time)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	rer := RepoEventRecord{
+		// a non-zero seq was assigned by the event manager, otherwise the
+		// database assigns one
+		Seq:    uint(evt.Seq),
 		Commit: util.DbCID{cid.Cid(evt.Commit)},
 		Prev:   prev,
 		Repo:   uid,
@@ -105,6 +140,15 @@ func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 		Time:   t,
 	}
 
+	if p.persistRouting {
+		relevant, err := encodeRelevantPds(e.PrivRelevantPds)
+		if err != nil {
+			return 0, err
+		}
+		rer.PdsId = e.PrivPdsId
+		rer.RelevantPds = relevant
+	}
+
 	for _, op := range evt.Ops {
 		var rec *util.DbCID
 		if op.Cid != nil && op.Cid.Defined() {
@@ -116,17 +160,80 @@ func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 			Rec:    rec,
 		})
 	}
-	if err := p.db.Create(&rer).Error; err != nil {
-		return err
+	if err := db.Create(&rer).Error; err != nil {
+		return 0, err
 	}
 
-	e.RepoCommit.Seq = int64(rer.Seq)
+	// the event isn't kept, so it is safe to stamp the seq the database
+	// assigned
+	evt.Seq = int64(rer.Seq)
 
-	return nil
+	return int64(rer.Seq), nil
+}
+
+func (p *DbPersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return persistEach(ctx, p, es)
+}
+
+// BeginBatch runs the batch in a database transaction.
+func (p *DbPersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	tx := p.db.WithContext(ctx).Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	return &dbBatch{p: p, tx: tx}, nil
+}
+
+type dbBatch struct {
+	p  *DbPersistence
+	tx *gorm.DB
+}
+
+func (b *dbBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	return b.p.persist(ctx, b.tx, e)
+}
+
+func (b *dbBatch) Commit(ctx context.Context) error {
+	return b.tx.Commit().Error
+}
+
+func (b *dbBatch) Rollback(ctx context.Context) error {
+	return b.tx.Rollback().Error
 }
 
 func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
-	rows, err := p.db.Model(RepoEventRecord{}).Where("seq > ?", since).Order("seq asc").Rows()
+	return p.playback(ctx, p.db.Model(RepoEventRecord{}).Where("seq > ?", since), cb)
+}
+
+func (p *DbPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	uid, err := p.uidForDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return p.playback(ctx, p.db.Model(RepoEventRecord{}).Where("repo = ? AND seq > ?", uid, since), cb)
+}
+
+// PlaybackByTime uses the index on the commit time. Only commits are stored,
+// and they always have a valid time.
+func (p *DbPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	q := p.db.Model(RepoEventRecord{})
+	if !from.IsZero() {
+		q = q.Where(clause.Gte{Column: clause.Column{Name: "time"}, Value: from})
+	}
+	if !to.IsZero() {
+		q = q.Where(clause.Lt{Column: clause.Column{Name: "time"}, Value: to})
+	}
+
+	return p.playback(ctx, q, cb)
+}
+
+func (p *DbPersistence) playback(ctx context.Context, q *gorm.DB, cb func(*XRPCStreamEvent) error) error {
+	rows, err := q.Order("seq asc").Rows()
 	if err != nil {
 		return err
 	}
@@ -150,7 +257,18 @@ func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPC
 			return fmt.Errorf("hydrating event: %w", err)
 		}
 
-		if err := cb(&XRPCStreamEvent{RepoCommit: ra}); err != nil {
+		xevt := &XRPCStreamEvent{RepoCommit: ra}
+		if p.persistRouting {
+			relevant, err := decodeRelevantPds(evt.RelevantPds)
+			if err != nil {
+				return fmt.Errorf("decoding event %d: %w", evt.Seq, err)
+			}
+			xevt.PrivUid = evt.Repo
+			xevt.PrivPdsId = evt.PdsId
+			xevt.PrivRelevantPds = relevant
+		}
+
+		if err := cb(xevt); err != nil {
 			return err
 		}
 	}
@@ -158,6 +276,24 @@ func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+func (p *DbPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	if err := p.db.Model(RepoEventRecord{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error; err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (p *DbPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	if err := p.db.Model(RepoEventRecord{}).Select("coalesce(min(seq), 0)").Scan(&seq).Error; err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
 func (p *DbPersistence) uidForDid(ctx context.Context, did string) (util.Uid, error) {
 	var u models.ActorInfo
 	if err := p.db.First(&u, "did = ?", did).Error; err != nil {
@@ -256,6 +392,22 @@ func (p *DbPersistence) readCarSlice(ctx context.Context, rer *RepoEventRecord)
 	return buf.Bytes(), nil
 }
 
+// Prune deletes commit events with seqs below beforeSeq, along with their
+// ops.
+func (p *DbPersistence) Prune(ctx context.Context, beforeSeq int64) (int64, error) {
+	db := p.db.WithContext(ctx)
+	if err := db.Where("repo_event_record_id < ?", beforeSeq).Delete(&RepoOpRecord{}).Error; err != nil {
+		return 0, fmt.Errorf("failed to delete repo op records: %w", err)
+	}
+
+	res := db.Where("seq < ?", beforeSeq).Delete(&RepoEventRecord{})
+	if err := res.Error; err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected, nil
+}
+
 func (p *DbPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
 	for {
 		q := p.db.Model(&RepoEventRecord{}).Where("repo = ?", usr).Limit(100).Select("seq")
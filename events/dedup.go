@@ -0,0 +1,123 @@
+package events
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ErrDuplicateEvent is returned by AddEvent when deduplication is enabled
+// and the event was already submitted within the window. The event is
+// dropped; producers retrying an ambiguous failure can treat this as success.
+var ErrDuplicateEvent = errors.New("duplicate event dropped")
+
+// dedupWindow remembers the keys of the most recently submitted events. It
+// is shared by all producers, so unlike most manager state it has its own
+// lock.
+type dedupWindow struct {
+	lk sync.Mutex
+
+	// ring holds the keys in submission order, evicting the oldest once
+	// full, and seen maps each key to its slot in ring
+	ring []string
+	next int
+	seen map[string]int
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		ring: make([]string, size),
+		seen: make(map[string]int, size),
+	}
+}
+
+// add records key, returning false if it is already in the window.
+func (w *dedupWindow) add(key string) bool {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if _, ok := w.seen[key]; ok {
+		return false
+	}
+
+	// the slot's old key may have been forgotten and added again since, in
+	// which case it lives in another slot now
+	if old := w.ring[w.next]; old != "" && w.seen[old] == w.next {
+		delete(w.seen, old)
+	}
+
+	w.ring[w.next] = key
+	w.seen[key] = w.next
+	w.next = (w.next + 1) % len(w.ring)
+
+	return true
+}
+
+// forget removes keys from the window, for events that were never accepted,
+// so a retry isn't mistaken for a duplicate.
+func (w *dedupWindow) forget(keys []string) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	for _, k := range keys {
+		delete(w.seen, k)
+	}
+}
+
+// dedupKey returns the key evt is deduplicated on: its seq, or with
+// DedupByContent a hash of its encoding. Events without a seq can only be
+// deduplicated by content.
+func (em *EventManager) dedupKey(evt *XRPCStreamEvent) (string, bool) {
+	if em.dedupByContent {
+		var buf bytes.Buffer
+		if err := evt.MarshalFrames(&buf); err != nil {
+			return "", false
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		return string(sum[:]), true
+	}
+
+	seq := evt.sequence()
+	if seq == 0 {
+		return "", false
+	}
+
+	return strconv.FormatInt(seq, 10), true
+}
+
+// dedupe drops the events already in the dedup window, recording the rest,
+// and returns those kept along with the keys recorded for them.
+func (em *EventManager) dedupe(evs []*XRPCStreamEvent) ([]*XRPCStreamEvent, []string) {
+	if em.dedup == nil {
+		return evs, nil
+	}
+
+	kept := evs[:0:0]
+	var keys []string
+	for _, ev := range evs {
+		key, ok := em.dedupKey(ev)
+		if !ok {
+			kept = append(kept, ev)
+			continue
+		}
+
+		if !em.dedup.add(key) {
+			continue
+		}
+
+		kept = append(kept, ev)
+		keys = append(keys, key)
+	}
+
+	return kept, keys
+}
+
+// forgetDedup removes keys returned by dedupe from the window.
+func (em *EventManager) forgetDedup(keys []string) {
+	if em.dedup != nil && len(keys) > 0 {
+		em.dedup.forget(keys)
+	}
+}
@@ -0,0 +1,190 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+// dedupManager starts a manager on p and subscribes to everything it
+// broadcasts, returning a function that reads the handles of the next n
+// events delivered and checks nothing else is.
+func dedupManager(t *testing.T, ctx context.Context, p EventPersistence, opts *EventManagerOpts) (*EventManager, func(n int) []string) {
+	t.Helper()
+
+	em := NewEventManagerWithOpts(p, opts)
+	go em.Run(ctx)
+	t.Cleanup(func() { em.Shutdown(context.Background()) })
+
+	sub, err := em.SubscribeHandle(ctx, func(*XRPCStreamEvent) bool { return true }, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(n int) []string {
+		t.Helper()
+		var got []string
+		for len(got) < n {
+			select {
+			case e := <-sub.Events():
+				got = append(got, e.RepoHandle.Handle)
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for events, got %v", got)
+			}
+		}
+
+		// and nothing else was let through
+		select {
+		case e := <-sub.Events():
+			t.Fatalf("expected only %v, also got %s", got, e.RepoHandle.Handle)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		return got
+	}
+
+	return em, next
+}
+
+func dedupEvent(seq int64, handle string) *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    seq,
+			Did:    "did:plc:dedup",
+			Handle: handle,
+		},
+	}
+}
+
+func expectHandles(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDedupBySeq(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, next := dedupManager(t, ctx, NewMemPersister(), &EventManagerOpts{DedupWindow: 3})
+
+	add := func(seq int64, handle string, dup bool) {
+		t.Helper()
+		err := em.AddEvent(ctx, dedupEvent(seq, handle))
+		if dup && !errors.Is(err, ErrDuplicateEvent) {
+			t.Fatalf("expected %s (seq %d) to be dropped as a duplicate, got %v", handle, seq, err)
+		}
+		if !dup && err != nil {
+			t.Fatalf("expected %s (seq %d) to be accepted, got %v", handle, seq, err)
+		}
+	}
+
+	add(1, "a", false)
+	add(2, "b", false)
+	add(1, "a-again", true)
+	add(3, "c", false)
+	add(2, "b-again", true)
+	expectHandles(t, next(3), "a", "b", "c")
+
+	// seq 1 falls out of the window once three newer ones are in it, so it
+	// is no longer recognized, while seq 4 still is
+	add(4, "d", false)
+	add(1, "a-late", false)
+	add(4, "d-again", true)
+	expectHandles(t, next(2), "d", "a-late")
+}
+
+func TestDedupByContent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, next := dedupManager(t, ctx, NewMemPersister(), &EventManagerOpts{
+		AssignSeq:      true,
+		DedupWindow:    2,
+		DedupByContent: true,
+	})
+
+	add := func(handle string, dup bool) {
+		t.Helper()
+		err := em.AddEvent(ctx, dedupEvent(0, handle))
+		if dup && !errors.Is(err, ErrDuplicateEvent) {
+			t.Fatalf("expected %s to be dropped as a duplicate, got %v", handle, err)
+		}
+		if !dup && err != nil {
+			t.Fatalf("expected %s to be accepted, got %v", handle, err)
+		}
+	}
+
+	// without seqs, events only match if they encode the same
+	add("a", false)
+	add("a", true)
+	add("b", false)
+	add("a", true)
+	expectHandles(t, next(2), "a", "b")
+
+	add("c", false)
+	add("a", false)
+	add("c", true)
+	expectHandles(t, next(2), "c", "a")
+}
+
+func TestDedupBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, next := dedupManager(t, ctx, NewMemPersister(), &EventManagerOpts{DedupWindow: 8})
+
+	if err := em.AddEvents(ctx, []*XRPCStreamEvent{dedupEvent(1, "a"), dedupEvent(2, "b")}); err != nil {
+		t.Fatal(err)
+	}
+	expectHandles(t, next(2), "a", "b")
+
+	// repeats are dropped from a batch, both of earlier events and within it
+	if err := em.AddEvents(ctx, []*XRPCStreamEvent{
+		dedupEvent(2, "b-again"),
+		dedupEvent(3, "c"),
+		dedupEvent(3, "c-again"),
+	}); err != nil {
+		t.Fatalf("expected a partly duplicate batch to be accepted, got %v", err)
+	}
+	expectHandles(t, next(1), "c")
+
+	if err := em.AddEvents(ctx, []*XRPCStreamEvent{dedupEvent(1, "a-again"), dedupEvent(3, "c-again")}); !errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("expected a batch of only duplicates to fail with ErrDuplicateEvent, got %v", err)
+	}
+	next(0)
+}
+
+func TestDedupForgetsFailedEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := newFailingPersister()
+	em, next := dedupManager(t, ctx, p, &EventManagerOpts{
+		DedupWindow:        8,
+		FailOnPersistError: true,
+	})
+
+	if err := em.AddEventSync(ctx, dedupEvent(1, "a")); err == nil || errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("expected the persist to fail, got %v", err)
+	}
+
+	// the failed event was forgotten, so retrying it isn't a duplicate
+	p.setFailing(false)
+	if err := em.AddEventSync(ctx, dedupEvent(1, "a-retry")); err != nil {
+		t.Fatalf("expected the retry to be accepted, got %v", err)
+	}
+	if err := em.AddEventSync(ctx, dedupEvent(1, "a-again")); !errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("expected a repeat of the persisted event to be dropped, got %v", err)
+	}
+	expectHandles(t, next(1), "a-retry")
+}
@@ -1,19 +1,397 @@
 package events
 
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// DiskPersistence is an append-only log of events in a single file. Each
+// record is laid out as
+//
+//	[4 byte length][8 byte seq][CBOR event header][CBOR event body][4 byte crc32]
+//
+// where length covers the seq, header and body, and the checksum covers the
+// same bytes. An in-memory index from seq to file offset is rebuilt on
+// startup so Playback can seek straight to a cursor, along with an index of
+// each account's repo events for PlaybackByDID. A truncated or corrupt
+// record at the end of the file (from a crash mid-write) is discarded during
+// recovery. Each record is synced to disk before Persist returns, unless
+// NoSync is set, and records over 64MB are refused.
+//
+// With PersistRouting set, each event's private routing fields are appended
+// to the record after the body, where readers that don't expect them ignore
+// them.
 type DiskPersistence struct {
 	dir string
+
+	persistRouting bool
+	noSync         bool
+
+	lk    sync.Mutex
+	f     *os.File
+	size  int64
+	seq   int64
+	index []diskIndexEntry
+
+	// byDID maps an account to the positions in index of its repo events
+	byDID map[string][]int
+}
+
+type diskIndexEntry struct {
+	seq    int64
+	offset int64
+}
+
+const (
+	diskLogName      = "events.log"
+	diskRecordHeader = 4 + 8
+	diskRecordMax    = 64 << 20
+)
+
+// DiskOpts holds optional DiskPersistence settings.
+type DiskOpts struct {
+	// PersistRouting stores each event's PrivUid, PrivPdsId and
+	// PrivRelevantPds with it and restores them on playback, so replayed
+	// events route to subscribers the same way live ones do.
+	PersistRouting bool
+
+	// NoSync skips the fsync after each record is written. Persist is then
+	// much cheaper, but events it has returned for may be lost if the
+	// machine crashes, rather than just the process.
+	NoSync bool
 }
 
 func NewDiskPersistence(dir string) (*DiskPersistence, error) {
-	return &DiskPersistence{
-		dir: dir,
-	}, nil
+	return NewDiskPersistenceWithOpts(dir, nil)
+}
+
+func NewDiskPersistenceWithOpts(dir string, opts *DiskOpts) (*DiskPersistence, error) {
+	if opts == nil {
+		opts = &DiskOpts{}
+	}
+
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, diskLogName), os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &DiskPersistence{
+		dir:            dir,
+		persistRouting: opts.PersistRouting,
+		noSync:         opts.NoSync,
+		f:              f,
+		byDID:          make(map[string][]int),
+	}
+
+	if err := p.recover(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("recovering event log: %w", err)
+	}
+
+	return p, nil
+}
+
+// recover scans the log to rebuild the index and last seq, truncating any
+// partial record left at the end.
+func (p *DiskPersistence) recover() error {
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(p.f)
+	var offset int64
+	for {
+		var evt XRPCStreamEvent
+		seq, n, err := readDiskRecord(br, &evt)
+		if err != nil && !errors.Is(err, ErrUnknownFrame) {
+			if !errors.Is(err, io.EOF) {
+				log.Warnf("discarding torn or corrupt event log tail at offset %d: %s", offset, err)
+			}
+			break
+		}
+
+		p.addIndex(&evt, seq, offset)
+		p.seq = seq
+		offset += n
+	}
+
+	if err := p.f.Truncate(offset); err != nil {
+		return err
+	}
+	if err := p.f.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := p.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	p.size = offset
+
+	return nil
+}
+
+// readDiskRecord reads a single record, decoding the event into evt if it is
+// non-nil. It returns the record's seq and its total length on disk. A clean
+// end of file is reported as io.EOF; anything else incomplete or corrupt is
+// an error. An event of a kind this build doesn't know is reported with an
+// error wrapping ErrUnknownFrame, but with its seq and length, so it can be
+// skipped.
+func readDiskRecord(r io.Reader, evt *XRPCStreamEvent) (int64, int64, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, 0, fmt.Errorf("truncated record length")
+		}
+		return 0, 0, err
+	}
+
+	l := binary.BigEndian.Uint32(lenbuf[:])
+	if l < 8 || l > diskRecordMax {
+		return 0, 0, fmt.Errorf("invalid record length %d", l)
+	}
+
+	buf := make([]byte, int(l)+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, fmt.Errorf("truncated record: %w", err)
+	}
+
+	body, sum := buf[:l], buf[l:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return 0, 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	seq := int64(binary.BigEndian.Uint64(body[:8]))
+	if evt != nil {
+		br := bytes.NewReader(body[8:])
+		if err := evt.UnmarshalFrames(br); err != nil {
+			// records are self-delimiting, so an event of a kind this build
+			// doesn't know can still be stepped over
+			if errors.Is(err, ErrUnknownFrame) {
+				return seq, int64(len(lenbuf)) + int64(len(buf)), fmt.Errorf("decoding event %d: %w", seq, err)
+			}
+			return 0, 0, fmt.Errorf("decoding event %d: %w", seq, err)
+		}
+
+		// anything after the frames is the event's routing fields
+		if br.Len() > 0 {
+			if err := readRouting(body[len(body)-br.Len():], evt); err != nil {
+				return 0, 0, fmt.Errorf("decoding event %d: %w", seq, err)
+			}
+		}
+	}
+
+	return seq, int64(len(lenbuf)) + int64(len(buf)), nil
+}
+
+func (p *DiskPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	if !e.hasSequence() {
+		return 0, fmt.Errorf("cannot persist %s event", e.kind())
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	// respect seqs assigned by the event manager, otherwise number events
+	// ourselves. The index relies on seqs only ever increasing.
+	seq := e.sequence()
+	switch {
+	case seq == 0:
+		seq = p.seq + 1
+		e.setSequence(seq)
+	case seq <= p.seq:
+		return 0, fmt.Errorf("event seq %d is not after the last persisted seq %d", seq, p.seq)
+	}
+
+	rec := new(bytes.Buffer)
+	rec.Write(make([]byte, diskRecordHeader))
+	if err := e.MarshalFrames(rec); err != nil {
+		return 0, err
+	}
+	if p.persistRouting {
+		rec.Write(appendRouting(nil, e))
+	}
+
+	// readDiskRecord would take a longer record for a corrupt one and
+	// truncate it, along with everything after it, on the next start
+	b := rec.Bytes()
+	if l := len(b) - 4; l > diskRecordMax {
+		return 0, fmt.Errorf("%s event %d is %d bytes, over the %d byte record limit", e.kind(), seq, l, diskRecordMax)
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-4))
+	binary.BigEndian.PutUint64(b[4:12], uint64(seq))
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b[4:]))
+	rec.Write(sum[:])
+
+	if _, err := p.f.Write(rec.Bytes()); err != nil {
+		p.rollback()
+		return 0, err
+	}
+	if !p.noSync {
+		if err := p.f.Sync(); err != nil {
+			p.rollback()
+			return 0, err
+		}
+	}
+
+	p.addIndex(e, seq, p.size)
+	p.size += int64(rec.Len())
+	p.seq = seq
+
+	return seq, nil
+}
+
+func (p *DiskPersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return persistEach(ctx, p, es)
+}
+
+func (p *DiskPersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	return &nonTxBatch{p}, nil
+}
+
+func (p *DiskPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	p.lk.Lock()
+	index := p.index
+	end := p.size
+	p.lk.Unlock()
+
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].seq > since
+	})
+	if i == len(index) {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(p.dir, diskLogName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := index[i].offset
+	br := bufio.NewReader(io.NewSectionReader(f, start, end-start))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var evt XRPCStreamEvent
+		if _, _, err := readDiskRecord(br, &evt); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, ErrUnknownFrame) {
+				continue
+			}
+			return err
+		}
+
+		if err := cb(&evt); err != nil {
+			return err
+		}
+	}
+}
+
+// rollback truncates a failed append, leaving the file as it was so that the
+// next append isn't corrupt. The caller must hold lk.
+func (p *DiskPersistence) rollback() {
+	if err := p.f.Truncate(p.size); err != nil {
+		log.Errorf("failed to roll back partial event log write: %s", err)
+	}
+	if _, err := p.f.Seek(p.size, io.SeekStart); err != nil {
+		log.Errorf("failed to seek back to the end of the event log: %s", err)
+	}
+}
+
+// addIndex records the location of a persisted event. The caller must hold lk.
+func (p *DiskPersistence) addIndex(evt *XRPCStreamEvent, seq, offset int64) {
+	if did := evt.repoDID(); did != "" {
+		p.byDID[did] = append(p.byDID[did], len(p.index))
+	}
+	p.index = append(p.index, diskIndexEntry{seq: seq, offset: offset})
+}
+
+func (p *DiskPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	p.lk.Lock()
+	index := p.index
+	positions := p.byDID[did]
+	end := p.size
+	p.lk.Unlock()
+
+	i := sort.Search(len(positions), func(i int) bool {
+		return index[positions[i]].seq > since
+	})
+	if i == len(positions) {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(p.dir, diskLogName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, pos := range positions[i:] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := index[pos].offset
+		var evt XRPCStreamEvent
+		if _, _, err := readDiskRecord(bufio.NewReader(io.NewSectionReader(f, start, end-start)), &evt); err != nil {
+			return err
+		}
+
+		if err := cb(&evt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *DiskPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return playbackByTimeScan(ctx, p, from, to, cb)
+}
+
+func (p *DiskPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.seq, nil
+}
+
+func (p *DiskPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if len(p.index) == 0 {
+		return 0, nil
+	}
+	return p.index[0].seq, nil
 }
 
-func (p *DiskPersistence) Persist(e *XRPCStreamEvent) error {
-	panic("nyi")
+func (p *DiskPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	return fmt.Errorf("repo takedowns not supported by the append-only disk persister")
 }
 
-func (p *DiskPersistence) Playback(since int64, cb func(*XRPCStreamEvent) error) error {
-	panic("nyi")
+func (p *DiskPersistence) Close() error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.f.Close()
 }
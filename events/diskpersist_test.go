@@ -0,0 +1,185 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+func diskHandle(seq int64) *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    seq,
+			Did:    fmt.Sprintf("did:plc:%d", seq),
+			Handle: "test.example.com",
+		},
+	}
+}
+
+// diskSeqs plays back everything in p.
+func diskSeqs(t *testing.T, p *DiskPersistence) []int64 {
+	var seqs []int64
+	if err := p.Playback(context.Background(), 0, func(e *XRPCStreamEvent) error {
+		seqs = append(seqs, e.sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestDiskRecoversTornTail(t *testing.T) {
+	for name, damage := range map[string]func(t *testing.T, path string, size int64){
+		"truncated": func(t *testing.T, path string, size int64) {
+			// lose the last few bytes of the final record
+			if err := os.Truncate(path, size-3); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"corrupt": func(t *testing.T, path string, size int64) {
+			// flip a byte in the final record's checksum
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var b [1]byte
+			if _, err := f.ReadAt(b[:], size-1); err != nil {
+				t.Fatal(err)
+			}
+			b[0] ^= 0xff
+			if _, err := f.WriteAt(b[:], size-1); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"partial_header": func(t *testing.T, path string, size int64) {
+			// the start of a record that never got written
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.Write([]byte{0, 0}); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		damage := damage
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+
+			p, err := NewDiskPersistence(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for seq := int64(1); seq <= 3; seq++ {
+				if _, err := p.Persist(ctx, diskHandle(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			size := p.size
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			damage(t, filepath.Join(dir, diskLogName), size)
+
+			p, err = NewDiskPersistence(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			// a partial header is only damage after the last record
+			want := "[1 2]"
+			if name == "partial_header" {
+				want = "[1 2 3]"
+			}
+			if got := fmt.Sprint(diskSeqs(t, p)); got != want {
+				t.Fatalf("expected %s to survive, got %s", want, got)
+			}
+
+			// appends carry on from the last good record, and survive another
+			// restart
+			latest, err := p.LatestSeq(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Persist(ctx, diskHandle(latest+1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err = NewDiskPersistence(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			if got, want := len(diskSeqs(t, p)), int(latest+1); got != want {
+				t.Fatalf("expected %d events after reopening, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestDiskRejectsOversizedRecord(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a record over the size limit")
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	p, err := NewDiskPersistence(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Persist(ctx, diskHandle(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// no single field may be anywhere near the limit, but a batch of
+	// labels with long values gets there
+	long := strings.Repeat("x", 8000)
+	var labels []*label.Label
+	for i := 0; i < diskRecordMax/(2*len(long))+1; i++ {
+		labels = append(labels, &label.Label{
+			Src: "did:plc:labeler",
+			Uri: long,
+			Val: long,
+			Cts: "2024-01-01T00:00:00.000Z",
+		})
+	}
+	big := &XRPCStreamEvent{
+		LabelLabels: &label.SubscribeLabels_Labels{Seq: 2, Labels: labels},
+	}
+	if _, err := p.Persist(ctx, big); err == nil || !strings.Contains(err.Error(), "record limit") {
+		t.Fatalf("expected an event over the record limit to be refused, got %v", err)
+	}
+
+	// nothing was written, so later events aren't lost on restart
+	if _, err := p.Persist(ctx, diskHandle(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewDiskPersistence(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if got := fmt.Sprint(diskSeqs(t, p)); got != "[1 3]" {
+		t.Fatalf("expected [1 3] after reopening, got %s", got)
+	}
+}
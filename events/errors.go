@@ -0,0 +1,142 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error names shared by producers and subscribers, in addition to those used
+// by the subscription handler and for future cursors.
+const (
+	ErrorConsumerTooSlow = "ConsumerTooSlow"
+	ErrorInvalidEvent    = "InvalidEvent"
+	ErrorPersistFailed   = "PersistFailed"
+	ErrorFilterPanicked  = "FilterPanicked"
+
+	ErrorPlaybackUnsupported = "PlaybackUnsupported"
+	ErrorPlaybackFailed      = "PlaybackFailed"
+	ErrorShutdown            = "Shutdown"
+)
+
+// ErrManagerShutdown ends subscriptions when the event manager shuts down.
+var ErrManagerShutdown error = &StreamError{
+	Name:    ErrorShutdown,
+	Message: "event manager shut down",
+}
+
+// StreamError is an error in the vocabulary of ErrorFrame: a short machine
+// readable name and a human readable message. Errors returned to producers by
+// AddEvent and friends are StreamErrors where the manager knows what went
+// wrong, and the same errors can be sent to subscribers with Frame.
+type StreamError struct {
+	Name    string
+	Message string
+
+	// Err is the underlying cause, if any
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is a StreamError with the same name, so callers
+// can match on the kind of error regardless of its message.
+func (e *StreamError) Is(target error) bool {
+	t, ok := target.(*StreamError)
+	return ok && t.Name == e.Name
+}
+
+// Frame returns the error as an error frame event.
+func (e *StreamError) Frame() *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		Error: &ErrorFrame{
+			Error:   e.Name,
+			Message: e.Message,
+		},
+	}
+}
+
+// Err returns the error frame as a StreamError.
+func (f *ErrorFrame) Err() *StreamError {
+	return &StreamError{
+		Name:    f.Error,
+		Message: f.Message,
+	}
+}
+
+// AsStreamError returns err as a StreamError, mapping errors that aren't
+// already one to ErrorInternal.
+func AsStreamError(err error) *StreamError {
+	var serr *StreamError
+	if errors.As(err, &serr) {
+		return serr
+	}
+
+	return &StreamError{
+		Name:    ErrorInternal,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+// ErrFutureCursor is sent to subscribers whose cursor is ahead of the stream.
+func ErrFutureCursor(cursor int64) *StreamError {
+	return &StreamError{
+		Name:    ErrorFutureCursor,
+		Message: fmt.Sprintf("cursor %d is ahead of the latest seq", cursor),
+	}
+}
+
+// ErrConsumerTooSlow describes a subscriber that couldn't keep up.
+func ErrConsumerTooSlow(reason string) *StreamError {
+	return &StreamError{
+		Name:    ErrorConsumerTooSlow,
+		Message: reason,
+	}
+}
+
+// ErrInvalidEventFrame wraps a ValidateEvent failure. It still matches
+// ErrInvalidEvent with errors.Is.
+func ErrInvalidEventFrame(err error) *StreamError {
+	return &StreamError{
+		Name:    ErrorInvalidEvent,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+// ErrPersistFailed wraps an error returned by the persister.
+func ErrPersistFailed(err error) *StreamError {
+	return &StreamError{
+		Name:    ErrorPersistFailed,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+// ErrFilterPanicked ends a subscription whose filter or transform (named by
+// what) panicked. The panic value is logged rather than sent to the consumer.
+func ErrFilterPanicked(what string) *StreamError {
+	return &StreamError{
+		Name:    ErrorFilterPanicked,
+		Message: what + " panicked",
+	}
+}
+
+// ErrPlaybackFailed ends a subscription whose playback from its cursor failed
+// part way, so that it doesn't carry on live with events missing.
+func ErrPlaybackFailed(err error) *StreamError {
+	return &StreamError{
+		Name:    ErrorPlaybackFailed,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	label "github.com/bluesky-social/indigo/api/label"
@@ -11,211 +15,2489 @@ import (
 	"github.com/bluesky-social/indigo/util"
 	logging "github.com/ipfs/go-log"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 var log = logging.Logger("events")
 
+// EventManager persists events and fans them out to subscribers.
+//
+// Each subscriber receives events in the order the run loop accepted them,
+// which with AssignSeq is also strictly increasing seq order, including across
+// the handoff from playback to live events. This holds for inline and
+// goroutine delivery alike. Events may be missing from a subscriber's stream
+// (filtered, dropped on overflow or send timeout, or merged by label
+// coalescing) but are never reordered.
+//
+// The run loop only accepts operations in the order they were submitted
+// within a single Priority class. Info and error frames default to
+// PriorityHigh, so they can overtake normal events the same producer added
+// before them. Nor is the order between classes strict: after taking
+// priorityBurst operations in a row the run loop waits on all of the queues
+// at once, and if more than one has an operation waiting the one taken is
+// picked at random. Concurrent AddEvent calls are accepted in an unspecified
+// order, and without AssignSeq the seqs are whatever the producers set, so
+// subscribers only see increasing seqs if the producers submit in seq order
+// and in one class.
 type EventManager struct {
-	subs []*Subscriber
+	subs   []*Subscriber
+	router router
 
+	// ops is the queue for normal priority events, and highOps and lowOps
+	// those for the other classes (see Priority). Subscribes, queries and
+	// other control operations go on ctrlOps, which the run loop takes from
+	// first and keeps taking from while the persist breaker holds up events.
+	// opTurn counts the run loop's calls to nextOp.
 	ops        chan *Operation
+	highOps    chan *Operation
+	lowOps     chan *Operation
+	ctrlOps    chan *Operation
+	opTurn     uint64
 	closed     chan struct{}
+	closeOnce  sync.Once
+	running    atomic.Bool
+	runDone    chan struct{}
 	bufferSize int
 
+	// dropping is closed once buffered events are to be abandoned rather
+	// than delivered, and closing holds the subscribers closed by the run
+	// loop on its way out, for Shutdown to flush
+	shutdownMode ShutdownMode
+	dropping     chan struct{}
+	dropOnce     sync.Once
+	closing      []*Subscriber
+
+	// initLk serializes Init, and inited is set once it has succeeded
+	initLk sync.Mutex
+	inited bool
+
 	persister EventPersistence
+	metrics   *eventManagerMetrics
+	log       Logger
+
+	assignSeq          bool
+	detectGaps         bool
+	failOnPersistError bool
+	shouldPersist      func(*XRPCStreamEvent) bool
+	pruneInterval      time.Duration
+	retainSeqs         int64
+	atomicBatches      bool
+	maxSubscribers     int
+	inlineDelivery     bool
+	validation         ValidationMode
+	utilizationSample  time.Duration
+
+	persistRetries      int
+	persistRetryBackoff time.Duration
+	breaker             *persistBreaker
+
+	// dedup is non-nil if AddEvent drops recently seen events
+	dedup          *dedupWindow
+	dedupByContent bool
+
+	// tooBigSem bounds concurrent TooBig resolves
+	tooBigSem chan struct{}
+
+	// pressure holds the bits of the latest Pressure sample
+	pressure         atomic.Uint64
+	throttleAbove    float64
+	maxThrottleDelay time.Duration
+
+	// cursorHeartbeat is the InfoCursor interval, and labelStream whether
+	// the latest event published was a label batch, so heartbeats go out as
+	// label info frames
+	cursorHeartbeat time.Duration
+	labelStream     bool
+
+	// labels is non-nil if label batches are coalesced before broadcast
+	labels *labelCoalescer
+
+	// lastSeq is the most recent seq broadcast, owned by the run loop, and
+	// latestSeq mirrors it for readers off the loop
+	lastSeq   int64
+	latestSeq atomic.Int64
+
+	// tracked holds the named subscribers by id, for the delivery lag
+	// metrics, which are collected off the run loop
+	tracked sync.Map
+
+	nextSubID uint64
+}
+
+// EventManagerOpts holds optional event manager settings. The zero value
+// gives the same behavior as NewEventManager.
+type EventManagerOpts struct {
+	// AssignSeq makes the event manager the source of truth for sequence
+	// numbers. Each event passed to AddEvent is stamped with the next seq
+	// before it is persisted and broadcast, overwriting whatever the producer
+	// set. The counter is initialized from the persister's latest seq when
+	// Run starts. Events without a seq field (info and error frames) are not
+	// stamped.
+	AssignSeq bool
+
+	// DetectSeqGaps makes the manager track the last broadcast seq and, when
+	// an event's seq is not exactly one greater (a gap, or a seq that goes
+	// backwards), send subscribers an info frame named InfoSequenceGap ahead
+	// of the event so they know to reconcile. Only the run loop touches the
+	// tracked seq, so this adds no locking.
+	DetectSeqGaps bool
+
+	// FailOnPersistError aborts the broadcast of any event that fails to
+	// persist, so subscribers never see events that can't be replayed. In
+	// this mode AddEvent waits for the event to be processed and returns the
+	// persist error to the producer. By default persist errors are only
+	// logged and the event is broadcast anyway.
+	FailOnPersistError bool
+
+	// ShouldPersist, if set, decides which events are persisted. Events it
+	// rejects are still broadcast to live subscribers but never played
+	// back, which suits transient signaling frames that would only clutter
+	// the log. By default every event is persisted. Rejecting events that
+	// carry a seq leaves gaps in the persisted seqs.
+	ShouldPersist func(*XRPCStreamEvent) bool
+
+	// PruneInterval, if non-zero, makes Run periodically prune events from
+	// the persister, which must implement Pruner, keeping at least the most
+	// recent RetainSeqs seqs. Events that a subscriber catching up from a
+	// cursor has yet to play back are never pruned, though a subscriber
+	// arriving with an old cursor while a prune is in progress may find its
+	// events gone and be sent an InfoOutdatedCursor frame. With RetainSeqs
+	// zero, only events still needed by such subscribers are kept.
+	PruneInterval time.Duration
+	RetainSeqs    int64
+
+	// PersistRetries is how many times a failed persist is retried before
+	// the event counts as failing to persist. The first retry waits
+	// PersistRetryBackoff (100ms if zero), and each later one twice as long
+	// as the last, up to 10s. The run loop waits out the retries, holding up
+	// every producer meanwhile. Batches from AddEvents are only retried with
+	// AtomicBatches, since otherwise part of a failed batch may already be
+	// stored, and for the same reason a *TeeError from a TeePersistence,
+	// whose primary stored the event, is never retried.
+	PersistRetries      int
+	PersistRetryBackoff time.Duration
+
+	// PersistBreakerThreshold, if non-zero, opens a circuit breaker once
+	// this many persists in a row have failed, retries included. While it
+	// is open the run loop accepts no events, so producers block (once any
+	// ops buffer fills) rather than have events broadcast that aren't
+	// durable, though subscribes, unsubscribes, queries and filter updates
+	// still go through. After
+	// PersistBreakerCooldown (10s if zero) the breaker is half open and
+	// lets operations through again: if the next persist succeeds it
+	// closes, otherwise it opens for another cooldown. PersistBreakerState
+	// and the persist_breaker_state metric report the state.
+	PersistBreakerThreshold int
+	PersistBreakerCooldown  time.Duration
+
+	// AtomicBatches makes AddEvents all or nothing: the batch is persisted
+	// in a single BeginBatch transaction and only broadcast once it commits,
+	// and if any event fails to persist the batch is rolled back, nothing is
+	// broadcast and AddEvents returns the error. With a persister that
+	// doesn't support transactions, events persisted before the failure
+	// can't be rolled back and remain available to playback, though they
+	// are still not broadcast.
+	AtomicBatches bool
+
+	// MaxSubscribers, if non-zero, caps the number of concurrently registered
+	// subscribers. Subscribe returns ErrTooManySubscribers once the limit is
+	// reached.
+	MaxSubscribers int
+
+	// InlineDelivery makes the run loop send live events straight to each
+	// subscriber's outgoing channel instead of handing them to a delivery
+	// goroutine per subscriber. This avoids a goroutine per subscriber and a
+	// wakeup per event, which can be cheaper for a handful of subscribers,
+	// but every broadcast then costs the run loop a channel send per
+	// subscriber. Subscribers with a SendTimeout, KeepaliveInterval or
+	// ResolveTooBig always get their own delivery goroutine.
+	InlineDelivery bool
+
+	// Validation controls whether AddEvent checks events with ValidateEvent
+	// before submitting them, and whether invalid events are rejected or
+	// just logged. By default events are not checked.
+	Validation ValidationMode
+
+	// LabelCoalesceWindow, if non-zero, makes the manager hold label batches
+	// for up to this long after they are persisted and broadcast them as a
+	// single merged batch, carrying the seq of the last batch merged, so a
+	// burst of tiny batches costs consumers one event. Batches are still
+	// persisted individually. Only batches with consecutive seqs are merged:
+	// a seq gap, any other kind of event, or shutdown flushes what is being
+	// held first. AddEventSync may return before a held batch is broadcast.
+	LabelCoalesceWindow time.Duration
+
+	// OpsBufferSize, if non-zero, buffers this many operations between
+	// producers and the run loop, so AddEvent can return without waiting for
+	// the loop (and in particular a slow Persist) until the buffer fills up.
+	// Buffered events have not been persisted yet: they are lost if the
+	// process crashes, and any still buffered when the manager shuts down are
+	// discarded. Producers that need to know an event was persisted should
+	// use AddEventSync or FailOnPersistError. Each Priority class has a
+	// buffer of this size, as do control operations such as subscribes. The
+	// ops_queued metric shows how full they are.
+	OpsBufferSize int
+
+	// UtilizationSampleInterval is how often the run loop samples each
+	// subscriber's buffer utilization into the moving average reported by
+	// SubscriberStats. Zero means once a second.
+	UtilizationSampleInterval time.Duration
+
+	// DedupWindow, if non-zero, makes AddEvent remember the last this many
+	// events submitted and drop any repeat with ErrDuplicateEvent, for
+	// producers that may resubmit an event after a timeout or reconnect.
+	// Events are matched by seq, so those submitted without one (as with
+	// AssignSeq) are never dropped, unless DedupByContent matches them by a
+	// hash of their encoding instead. An event that fails to submit or, when
+	// AddEvent waits for it, to persist, is forgotten so it can be retried.
+	// AddEvents drops the repeats from a batch, returning ErrDuplicateEvent
+	// only if every event was one.
+	DedupWindow    int
+	DedupByContent bool
+
+	// TooBigConcurrency bounds how many SubscribeOpts.ResolveTooBig calls
+	// may run at once across all subscribers, so a burst of TooBig commits
+	// doesn't overwhelm the backend they are fetched from. Zero means 4.
+	TooBigConcurrency int
+
+	// ThrottleAbove, if non-zero, makes AddEvent and AddEvents push back on
+	// producers once Pressure exceeds it, by sleeping before submitting for
+	// a time proportional to how far above it is: nothing at ThrottleAbove,
+	// MaxThrottleDelay (100ms if zero) at 1. It must be below 1.
+	ThrottleAbove    float64
+	MaxThrottleDelay time.Duration
+
+	// ShutdownMode chooses whether events still buffered for subscribers
+	// when the manager shuts down are handed to their consumers or dropped.
+	// The default is ShutdownDrop. If Run's context is cancelled, rather
+	// than Shutdown being called, there is no deadline to drain by and
+	// buffered events are always dropped.
+	ShutdownMode ShutdownMode
+
+	// CursorHeartbeatInterval, if non-zero, sends every live subscriber an
+	// InfoCursor info frame this often, whose message is the seq of the
+	// latest event broadcast. Heartbeats are sent regardless of the
+	// subscriber's filter, event kinds and account or PDS restrictions, so
+	// a consumer can tell falling behind, when the heartbeat seq runs far
+	// ahead of the last event it took, from its filter simply not matching
+	// anything. They are skipped for subscribers still catching up and for
+	// those whose buffer is full.
+	CursorHeartbeatInterval time.Duration
+
+	// Logger receives the manager's log output. If nil, the package's
+	// "events" go-log logger is used.
+	Logger Logger
+}
+
+// Logger is the structured logging interface used by the event manager. It is
+// satisfied by the go-log and zap sugared loggers used throughout indigo, so a
+// service running several managers can give each its own named logger.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// ErrTooManySubscribers is returned by Subscribe when the manager already has
+// the maximum number of subscribers configured by MaxSubscribers.
+var ErrTooManySubscribers error = &StreamError{
+	Name:    ErrorTooManySubscribers,
+	Message: "too many subscribers",
 }
 
+// NewEventManager returns a manager that persists events with persister. If
+// persister is nil, events are not persisted (see NullPersistence).
 func NewEventManager(persister EventPersistence) *EventManager {
-	return &EventManager{
-		ops:        make(chan *Operation),
+	return NewEventManagerWithOpts(persister, nil)
+}
+
+func NewEventManagerWithOpts(persister EventPersistence, opts *EventManagerOpts) *EventManager {
+	if opts == nil {
+		opts = &EventManagerOpts{}
+	}
+
+	if persister == nil {
+		persister = NullPersistence{}
+	}
+
+	var logger Logger = log
+	if opts.Logger != nil {
+		logger = opts.Logger
+	}
+
+	var labels *labelCoalescer
+	if opts.LabelCoalesceWindow > 0 {
+		labels = &labelCoalescer{window: opts.LabelCoalesceWindow}
+	}
+
+	utilizationSample := opts.UtilizationSampleInterval
+	if utilizationSample <= 0 {
+		utilizationSample = time.Second
+	}
+
+	retryBackoff := opts.PersistRetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultPersistRetryBackoff
+	}
+
+	breaker := &persistBreaker{
+		threshold: opts.PersistBreakerThreshold,
+		cooldown:  opts.PersistBreakerCooldown,
+	}
+	if breaker.cooldown <= 0 {
+		breaker.cooldown = defaultBreakerCooldown
+	}
+
+	throttleAbove := opts.ThrottleAbove
+	if throttleAbove >= 1 {
+		logger.Warnw("ignoring ThrottleAbove, which must be below 1", "throttleAbove", throttleAbove)
+		throttleAbove = 0
+	}
+
+	maxThrottleDelay := opts.MaxThrottleDelay
+	if maxThrottleDelay <= 0 {
+		maxThrottleDelay = 100 * time.Millisecond
+	}
+
+	tooBigConcurrency := opts.TooBigConcurrency
+	if tooBigConcurrency <= 0 {
+		tooBigConcurrency = defaultTooBigConcurrency
+	}
+
+	var dedup *dedupWindow
+	if opts.DedupWindow > 0 {
+		dedup = newDedupWindow(opts.DedupWindow)
+	}
+
+	em := &EventManager{
+		log:        logger,
+		labels:     labels,
+		ops:        make(chan *Operation, opts.OpsBufferSize),
+		highOps:    make(chan *Operation, opts.OpsBufferSize),
+		lowOps:     make(chan *Operation, opts.OpsBufferSize),
+		ctrlOps:    make(chan *Operation, opts.OpsBufferSize),
 		closed:     make(chan struct{}),
+		runDone:    make(chan struct{}),
+		dropping:   make(chan struct{}),
 		bufferSize: 1024,
 		persister:  persister,
+		assignSeq:  opts.AssignSeq,
+		detectGaps: opts.DetectSeqGaps,
+
+		failOnPersistError: opts.FailOnPersistError,
+		shouldPersist:      opts.ShouldPersist,
+		pruneInterval:      opts.PruneInterval,
+		retainSeqs:         opts.RetainSeqs,
+		atomicBatches:      opts.AtomicBatches,
+		maxSubscribers:     opts.MaxSubscribers,
+		inlineDelivery:     opts.InlineDelivery,
+		validation:         opts.Validation,
+		utilizationSample:  utilizationSample,
+
+		persistRetries:      opts.PersistRetries,
+		persistRetryBackoff: retryBackoff,
+		breaker:             breaker,
+
+		dedup:          dedup,
+		dedupByContent: opts.DedupByContent,
+		tooBigSem:      make(chan struct{}, tooBigConcurrency),
+
+		throttleAbove:    throttleAbove,
+		maxThrottleDelay: maxThrottleDelay,
+
+		shutdownMode:    opts.ShutdownMode,
+		cursorHeartbeat: opts.CursorHeartbeatInterval,
 	}
+	em.metrics = newEventManagerMetrics(func() float64 { return float64(em.opsQueued()) })
+	em.metrics.subscriberLag = newSubscriberLagCollector(em.deliveryLags)
+
+	return em
 }
 
 const (
 	opSubscribe = iota
 	opUnsubscribe
 	opSend
+	opQuery
+	opSendBatch
+	opUpdateFilter
 )
 
 type Operation struct {
 	op  int
 	sub *Subscriber
 	evt *XRPCStreamEvent
+
+	// evts holds the events of an opSendBatch, in order
+	evts []*XRPCStreamEvent
+
+	// query is run by the run loop for opQuery, giving it safe access to
+	// loop-owned state
+	query func()
+
+	// filter is the subscriber's new filter for opUpdateFilter
+	filter func(*XRPCStreamEvent) bool
+
+	// result, if set, receives the outcome of an opSend or opSendBatch once
+	// the events have been persisted and broadcast (or dropped)
+	result chan error
+
+	// spanCtx is the span of the call that submitted the op, under which
+	// the run loop traces its persist and fan-out
+	spanCtx trace.SpanContext
+
+	// pri is the class of the queue the op is submitted to
+	pri Priority
 }
 
-func (em *EventManager) Run() {
-	for op := range em.ops {
-		switch op.op {
-		case opSubscribe:
-			em.subs = append(em.subs, op.sub)
-		case opUnsubscribe:
-			for i, s := range em.subs {
-				if s == op.sub {
-					em.subs[i] = em.subs[len(em.subs)-1]
-					em.subs = em.subs[:len(em.subs)-1]
-					break
-				}
-			}
-		case opSend:
-			if err := em.persister.Persist(context.TODO(), op.evt); err != nil {
-				log.Errorf("failed to persist outbound event: %s", err)
-			}
-
-			for _, s := range em.subs {
-				if s.filter(op.evt) {
-					select {
-					case s.outgoing <- op.evt:
-					case <-s.done:
-						go func(torem *Subscriber) {
-							select {
-							case em.ops <- &Operation{
-								op:  opUnsubscribe,
-								sub: torem,
-							}:
-							case <-em.closed:
-							}
-						}(s)
-					default:
-						log.Error("event overflow")
-					}
-				}
+func (op *Operation) reply(err error) {
+	if op.result != nil {
+		op.result <- err
+	}
+}
+
+// startSpan starts a span for work the run loop does on op's behalf, as a
+// child of the submitting call's span. The submitter's context isn't kept,
+// since its cancellation mustn't reach the persister once the op is
+// accepted. Ops submitted without a span get a no-op one.
+func (op *Operation) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if !op.spanCtx.IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	ctx = trace.ContextWithSpanContext(ctx, op.spanCtx)
+	return otel.Tracer("events").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Run processes subscribe, unsubscribe and send operations until the manager
+// is shut down or ctx is cancelled. It returns ctx.Err() if the context was
+// cancelled, and nil after a call to Shutdown. Either way, once Run returns
+// the manager no longer accepts operations.
+func (em *EventManager) Run(ctx context.Context) error {
+	em.running.Store(true)
+	defer close(em.runDone)
+	defer em.closeSubs()
+
+	if err := em.Init(ctx); err != nil {
+		em.stop()
+		em.abandon()
+		return err
+	}
+
+	if em.pruneInterval > 0 {
+		go em.pruneLoop(ctx)
+	}
+
+	sample := time.NewTicker(em.utilizationSample)
+	defer sample.Stop()
+
+	var heartbeat <-chan time.Time
+	if em.cursorHeartbeat > 0 {
+		t := time.NewTicker(em.cursorHeartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	var polled int
+	for {
+		// an open breaker stops taking events, pushing back on producers,
+		// though control operations such as unsubscribes still go through
+		high, ops, low := em.highOps, em.ops, em.lowOps
+		if em.breaker.get() == BreakerOpen {
+			high, ops, low = nil, nil, nil
+		} else if polled < priorityBurst {
+			// take waiting operations in priority order, but regularly fall
+			// through to the select below so that a steady stream of them
+			// can't hold off the loop's other work
+			if op := em.nextOp(); op != nil {
+				polled++
+				em.handleOp(op)
+				continue
 			}
-		default:
-			log.Errorf("unrecognized eventmgr operation: %d", op.op)
+		}
+		polled = 0
+
+		select {
+		case op := <-em.ctrlOps:
+			em.handleOp(op)
+		case op := <-high:
+			em.handleOp(op)
+		case op := <-ops:
+			em.handleOp(op)
+		case op := <-low:
+			em.handleOp(op)
+		case <-em.breaker.resumeC():
+			em.halfOpenBreaker()
+		case <-sample.C:
+			em.sampleUtilization()
+			em.samplePressure()
+		case <-heartbeat:
+			em.heartbeat()
+		case <-em.labels.flushC():
+			em.flushLabels()
+		case <-em.closed:
+			return nil
+		case <-ctx.Done():
+			em.stop()
+			em.abandon()
+			return ctx.Err()
 		}
 	}
 }
 
-type Subscriber struct {
-	outgoing chan *XRPCStreamEvent
+// Init prepares the manager to run. With AssignSeq it loads the latest
+// persisted seq, so that assigned seqs continue from where the previous run
+// left off. Run calls Init before taking any operations, so calling it first
+// is optional, but lets a service fail fast on an unreachable persister
+// before it starts serving. Init may be retried after an error, and does
+// nothing once it has succeeded.
+//
+// Producers may call AddEvent at any time, including before or during Init.
+// Seqs are only assigned by the run loop, which receives no operations until
+// Init has succeeded, so until then their events wait in the ops buffer or
+// AddEvent blocks, and the first seq assigned is always the latest persisted
+// seq plus one.
+func (em *EventManager) Init(ctx context.Context) error {
+	em.initLk.Lock()
+	defer em.initLk.Unlock()
 
-	filter func(*XRPCStreamEvent) bool
+	if em.inited || !em.assignSeq {
+		em.inited = true
+		return nil
+	}
 
-	done chan struct{}
+	seq, err := em.persister.LatestSeq(ctx)
+	if err != nil {
+		return fmt.Errorf("loading latest seq from persister: %w", err)
+	}
+
+	em.setLastSeq(seq)
+	em.inited = true
+	return nil
 }
 
-const (
-	EvtKindErrorFrame = -1
-	EvtKindMessage    = 1
-)
+func (em *EventManager) setLastSeq(seq int64) {
+	em.lastSeq = seq
+	em.latestSeq.Store(seq)
+}
 
-type EventHeader struct {
-	Op      int64  `cborgen:"op"`
-	MsgType string `cborgen:"t"`
+func (em *EventManager) closeSubs() {
+	// don't lose label batches that were persisted but held for coalescing
+	em.flushLabels()
+
+	// we are the only writer to registered subscribers, so it is safe to
+	// close their channels here. Consumers see a clean EOF, and
+	// ErrManagerShutdown from Subscription.Err.
+	for _, s := range em.subs {
+		s.end(ErrManagerShutdown)
+
+		// subscribers with a delivery goroutine close outgoing once their
+		// queue is closed
+		if s.queue != nil {
+			s.closeQueue()
+			continue
+		}
+
+		// subscribers still catching up close their own channel
+		s.lk.Lock()
+		if s.live.Load() {
+			em.finish(s)
+		}
+		s.lk.Unlock()
+	}
+	em.closing = em.subs
+	em.subs = nil
+	em.router = router{}
+	em.tracked.Range(func(id, _ any) bool {
+		em.tracked.Delete(id)
+		return true
+	})
+	em.metrics.subscribers.Set(0)
 }
 
-type XRPCStreamEvent struct {
-	Error         *ErrorFrame
-	RepoCommit    *comatproto.SyncSubscribeRepos_Commit
-	RepoHandle    *comatproto.SyncSubscribeRepos_Handle
-	RepoInfo      *comatproto.SyncSubscribeRepos_Info
-	RepoMigrate   *comatproto.SyncSubscribeRepos_Migrate
-	RepoTombstone *comatproto.SyncSubscribeRepos_Tombstone
-	LabelLabels   *label.SubscribeLabels_Labels
-	LabelInfo     *label.SubscribeLabels_Info
+func (em *EventManager) removeSub(sub *Subscriber) {
+	for i, s := range em.subs {
+		if s == sub {
+			em.subs[i] = em.subs[len(em.subs)-1]
+			em.subs = em.subs[:len(em.subs)-1]
+			em.router.remove(s)
+			em.tracked.Delete(s.id)
+			em.metrics.subscribers.Set(float64(len(em.subs)))
+			if s.queue != nil {
+				s.closeQueue()
+			}
+			return
+		}
+	}
+}
 
-	// some private fields for internal routing perf
-	PrivUid         util.Uid `json:"-" cborgen:"-"`
-	PrivPdsId       uint     `json:"-" cborgen:"-"`
-	PrivRelevantPds []uint   `json:"-" cborgen:"-"`
+func (em *EventManager) handleOp(op *Operation) {
+	switch op.op {
+	case opSubscribe:
+		if em.maxSubscribers > 0 && len(em.subs) >= em.maxSubscribers {
+			em.metrics.rejectedSubs.Inc()
+			op.reply(ErrTooManySubscribers)
+			return
+		}
+
+		em.nextSubID++
+		op.sub.id = em.nextSubID
+		op.sub.connectedAt = time.Now()
+		op.sub.markSeen(em.lastSeq)
+		em.subs = append(em.subs, op.sub)
+		em.router.add(op.sub)
+		if op.sub.name != "" && !op.sub.tail {
+			em.tracked.Store(op.sub.id, op.sub)
+		}
+		em.metrics.subscribers.Set(float64(len(em.subs)))
+		op.reply(nil)
+	case opUnsubscribe:
+		em.removeSub(op.sub)
+	case opSend:
+		em.handleSend(op)
+	case opSendBatch:
+		em.handleSendBatch(op)
+	case opQuery:
+		op.query()
+		op.reply(nil)
+	case opUpdateFilter:
+		op.sub.setFilter(op.filter)
+		op.reply(nil)
+	default:
+		em.log.Errorw("unrecognized eventmgr operation", "op", op.op)
+	}
 }
 
-type ErrorFrame struct {
-	Error   string `cborgen:"error"`
-	Message string `cborgen:"message"`
+func (em *EventManager) handleSend(op *Operation) {
+	// seqs are assigned here rather than in AddEvent so that assignment
+	// order and broadcast order are always the same
+	if em.assignSeq && op.evt.hasSequence() {
+		op.evt.setSequence(em.lastSeq + 1)
+	}
+
+	if !em.persists(op.evt) {
+		em.tracedPublish(op, op.evt)
+		op.reply(nil)
+		return
+	}
+
+	ctx, span := op.startSpan("persist", attribute.String("kind", op.evt.kind()))
+	var seq int64
+	var persistErr error
+	err := em.persistWithRetry(func() (bool, error) {
+		var err error
+		seq, err = em.persister.Persist(ctx, op.evt)
+		return retryable(err), err
+	})
+	span.SetAttributes(attribute.Int64("seq", seq))
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+
+	if err != nil {
+		em.log.Errorw("failed to persist outbound event", "err", err, "kind", op.evt.kind(), "seq", op.evt.sequence())
+		em.metrics.persistErrors.WithLabelValues(op.evt.kind()).Inc()
+
+		persistErr = ErrPersistFailed(fmt.Errorf("persisting event: %w", err))
+		if em.failOnPersistError {
+			// a tee's primary stored the event, so its seq is taken even
+			// though it isn't broadcast
+			if seq := op.evt.sequence(); !retryable(err) && seq > em.lastSeq {
+				em.setLastSeq(seq)
+			}
+			op.reply(persistErr)
+			return
+		}
+	}
+
+	em.tracedPublish(op, op.evt)
+	op.reply(persistErr)
 }
 
-func (em *EventManager) AddEvent(ctx context.Context, ev *XRPCStreamEvent) error {
-	ctx, span := otel.Tracer("events").Start(ctx, "AddEvent")
+// tracedPublish publishes evts under a fan-out span that is a child of op's
+// submitter's.
+func (em *EventManager) tracedPublish(op *Operation, evts ...*XRPCStreamEvent) {
+	_, span := op.startSpan("broadcast",
+		attribute.String("kind", evts[0].kind()),
+		attribute.Int64("seq", evts[0].sequence()),
+		attribute.Int("events", len(evts)),
+	)
 	defer span.End()
 
-	select {
-	case em.ops <- &Operation{
-		op:  opSend,
-		evt: ev,
-	}:
-		return nil
-	case <-em.closed:
-		return fmt.Errorf("event manager shut down")
+	var handed int
+	for _, evt := range evts {
+		handed += em.publish(evt)
 	}
+	span.SetAttributes(attribute.Int("subscribers", handed))
 }
 
-func (em *EventManager) AddLabelEvent(ev *XRPCStreamEvent) error {
-	select {
-	case em.ops <- &Operation{
-		op:  opSend,
-		evt: ev,
-	}:
+// handleSendBatch is handleSend for a batch of events, persisted with a
+// single PersistBatch call. If the batch fails to persist and the manager
+// fails on persist errors, none of it is broadcast.
+func (em *EventManager) handleSendBatch(op *Operation) {
+	if em.assignSeq {
+		next := em.lastSeq
+		for _, evt := range op.evts {
+			if evt.hasSequence() {
+				next++
+				evt.setSequence(next)
+			}
+		}
+	}
+
+	ctx, span := op.startSpan("persist",
+		attribute.String("kind", op.evts[0].kind()),
+		attribute.Int64("seq", op.evts[0].sequence()),
+		attribute.Int("events", len(op.evts)),
+	)
+
+	if em.atomicBatches {
+		var stranded int
+		err := em.persistWithRetry(func() (bool, error) {
+			var err error
+			stranded, err = em.persistAtomic(ctx, op.evts)
+			return stranded == 0 && retryable(err), err
+		})
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+
+		if err != nil {
+			em.log.Errorw("failed to persist outbound event batch, discarding it", "err", err, "count", len(op.evts))
+			for _, evt := range op.evts {
+				em.metrics.persistErrors.WithLabelValues(evt.kind()).Inc()
+			}
+
+			// don't hand out seqs again that are already taken by events we
+			// couldn't roll back
+			if stranded > 0 {
+				if seq := op.evts[stranded-1].sequence(); seq > em.lastSeq {
+					em.setLastSeq(seq)
+				}
+			}
+
+			op.reply(ErrPersistFailed(fmt.Errorf("persisting event batch: %w", err)))
+			return
+		}
+
+		em.tracedPublish(op, op.evts...)
+		op.reply(nil)
+		return
+	}
+
+	var persistErr error
+	err := em.persistWithRetry(func() (bool, error) {
+		return false, em.persistBatch(ctx, op.evts)
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+
+	if err != nil {
+		em.log.Errorw("failed to persist outbound event batch", "err", err, "count", len(op.evts), "firstSeq", op.evts[0].sequence())
+		for _, evt := range op.evts {
+			em.metrics.persistErrors.WithLabelValues(evt.kind()).Inc()
+		}
+
+		persistErr = ErrPersistFailed(fmt.Errorf("persisting event batch: %w", err))
+		if em.failOnPersistError {
+			op.reply(persistErr)
+			return
+		}
+	}
+
+	em.tracedPublish(op, op.evts...)
+	op.reply(persistErr)
+}
+
+// persists reports whether evt should be persisted.
+func (em *EventManager) persists(evt *XRPCStreamEvent) bool {
+	return em.shouldPersist == nil || em.shouldPersist(evt)
+}
+
+// persistBatch persists those of evts that should be persisted with a single
+// PersistBatch call.
+func (em *EventManager) persistBatch(ctx context.Context, evts []*XRPCStreamEvent) error {
+	if em.shouldPersist != nil {
+		keep := make([]*XRPCStreamEvent, 0, len(evts))
+		for _, evt := range evts {
+			if em.shouldPersist(evt) {
+				keep = append(keep, evt)
+			}
+		}
+		evts = keep
+	}
+
+	if len(evts) == 0 {
 		return nil
-	case <-em.closed:
-		return fmt.Errorf("event manager shut down")
 	}
+
+	return em.persister.PersistBatch(ctx, evts)
 }
 
-var ErrPlaybackShutdown = fmt.Errorf("playback shutting down")
+// persistAtomic persists evts in a single batch transaction, stamping each
+// with the seq it was stored under, and rolls back if any of them fails. If
+// the rollback fails too, or a tee's primary committed the batch but a mirror
+// didn't, it returns how many events from the front of the batch remain
+// persisted.
+func (em *EventManager) persistAtomic(ctx context.Context, evts []*XRPCStreamEvent) (int, error) {
+	tx, err := em.persister.BeginBatch(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-func (em *EventManager) Subscribe(ctx context.Context, filter func(*XRPCStreamEvent) bool, since *int64) (<-chan *XRPCStreamEvent, func(), error) {
-	if filter == nil {
-		filter = func(*XRPCStreamEvent) bool { return true }
+	for i, evt := range evts {
+		if !em.persists(evt) {
+			continue
+		}
+
+		if _, err := tx.Persist(ctx, evt); err != nil {
+			if rerr := tx.Rollback(ctx); rerr != nil {
+				em.log.Errorw("failed to roll back event batch", "err", rerr, "count", len(evts), "persisted", i)
+				return i, err
+			}
+			return 0, err
+		}
 	}
 
-	done := make(chan struct{})
-	sub := &Subscriber{
-		outgoing: make(chan *XRPCStreamEvent, em.bufferSize),
-		filter:   filter,
-		done:     done,
+	if err := tx.Commit(ctx); err != nil {
+		// a tee whose primary committed has the whole batch stored
+		if !retryable(err) {
+			return len(evts), err
+		}
+		return 0, err
 	}
 
-	go func() {
-		if since != nil {
-			if err := em.persister.Playback(ctx, *since, func(e *XRPCStreamEvent) error {
-				select {
-				case <-done:
-					return ErrPlaybackShutdown
-				case sub.outgoing <- e:
-					return nil
-				}
-			}); err != nil {
-				if errors.Is(err, ErrPlaybackShutdown) {
-					log.Warnf("events playback: %s", err)
-				} else {
-					log.Errorf("events playback: %s", err)
+	return 0, nil
+}
+
+// publish records a persisted event's seq and broadcasts it, preceded by a
+// gap info frame if gap detection is enabled and the seq isn't the next one.
+// It returns the number of subscribers the event was handed to, which is
+// zero for label batches held for coalescing.
+func (em *EventManager) publish(evt *XRPCStreamEvent) int {
+	seq := evt.sequence()
+	gap := seq != 0 && em.lastSeq != 0 && seq != em.lastSeq+1
+	coalesce := em.labels != nil && evt.LabelLabels != nil
+	if gap || !coalesce {
+		em.flushLabels()
+	}
+
+	if em.detectGaps && gap {
+		msg := fmt.Sprintf("expected seq %d, got %d", em.lastSeq+1, seq)
+		em.broadcast(infoEvent(evt, InfoSequenceGap, msg))
+	}
+
+	if seq > em.lastSeq {
+		em.setLastSeq(seq)
+	}
+	em.labelStream = evt.LabelLabels != nil
+
+	if coalesce {
+		em.labels.add(evt)
+		return 0
+	}
+
+	return em.broadcast(evt)
+}
+
+// broadcast delivers evt to every subscriber whose filter accepts it,
+// skipping subscribers restricted to other accounts or PDSes without
+// consulting their filters. It returns the number of subscribers the event
+// was handed to.
+func (em *EventManager) broadcast(evt *XRPCStreamEvent) int {
+	start := time.Now()
+	kind := evt.kind()
+	seq := evt.sequence()
+
+	var handed int
+	var evicted, faulted []*Subscriber
+	var compressed *XRPCStreamEvent
+	for _, s := range em.router.targets(evt, em.subs) {
+		if !s.accepts(evt) {
+			if s.faulted() {
+				faulted = append(faulted, s)
+				continue
+			}
+			s.markSeen(seq)
+			continue
+		}
+
+		// staged events are transformed when catch up flushes them
+		if s.stage(evt) {
+			handed++
+			continue
+		}
+
+		out := em.prepare(s, evt, &compressed)
+		if out == nil {
+			if s.faulted() {
+				faulted = append(faulted, s)
+				continue
+			}
+			s.markSeen(seq)
+			continue
+		}
+
+		if s.queue != nil {
+			select {
+			case s.queue <- out:
+				s.fullSince = time.Time{}
+				s.markSeen(seq)
+				handed++
+			default:
+				em.noteOverflow(s, kind, seq)
+				if reason := s.recordOverflow(); reason != "" {
+					s.evictReason = reason
+					evicted = append(evicted, s)
 				}
 			}
+			continue
 		}
 
-		// if cancel happens before playback completes
 		select {
-		case <-done:
-			return
+		case s.outgoing <- out:
+			s.fullSince = time.Time{}
+			s.markSeen(seq)
+			s.recordDelivery(out)
+			handed++
+		case <-s.done:
+			go func(torem *Subscriber) {
+				select {
+				case em.ctrlOps <- &Operation{
+					op:  opUnsubscribe,
+					sub: torem,
+				}:
+				case <-em.closed:
+				}
+			}(s)
 		default:
+			em.noteOverflow(s, kind, seq)
+			if reason := s.recordOverflow(); reason != "" {
+				s.evictReason = reason
+				evicted = append(evicted, s)
+			}
 		}
+	}
 
-		select {
-		case em.ops <- &Operation{
-			op:  opSubscribe,
-			sub: sub,
-		}:
-		case <-em.closed:
-			log.Errorf("failed to subscribe, event manager shut down")
-		}
-	}()
+	em.metrics.broadcast.WithLabelValues(kind).Inc()
+	em.metrics.broadcastDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
 
-	cleanup := func() {
-		close(done)
-		select {
-		case em.ops <- &Operation{
-			op:  opUnsubscribe,
-			sub: sub,
-		}:
-		case <-em.closed:
+	for _, s := range evicted {
+		em.log.Warnw("evicting slow subscriber", "sub", s.id, "name", s.name, "reason", s.evictReason)
+		s.end(ErrConsumerTooSlow(s.evictReason))
+		em.removeSub(s)
+		if s.queue == nil {
+			em.finish(s)
 		}
 	}
 
-	return sub.outgoing, cleanup, nil
+	for _, s := range faulted {
+		em.evictFaulted(s)
+	}
+
+	return handed
+}
+
+// deliver forwards events from a subscriber's queue to its outgoing channel.
+// It runs in its own goroutine once the subscriber is live, so broadcast only
+// has to enqueue and a slow consumer only holds up its own delivery. Without
+// a send timeout it waits as long as it takes for the consumer, and events
+// back up in the queue until broadcast starts dropping them; with one, an
+// event the consumer doesn't take in time is dropped here instead. It is the
+// only writer to outgoing from then on, and closes it when the queue is
+// closed or the subscriber is evicted.
+func (em *EventManager) deliver(s *Subscriber) {
+	defer em.finish(s)
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if s.sendTimeout > 0 {
+		timer = time.NewTimer(s.sendTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// keepalive fires once nothing has been sent for the keepalive interval
+	var keepalive *time.Timer
+	var idle <-chan time.Time
+	if s.keepalive > 0 {
+		keepalive = time.NewTimer(s.keepalive)
+		defer keepalive.Stop()
+		idle = keepalive.C
+	}
+
+	var last *XRPCStreamEvent
+	for {
+		select {
+		case <-em.dropping:
+			return
+		default:
+		}
+
+		// a subscriber out of credits stops taking from its queue, leaving
+		// live events to back up there
+		queue := s.queue
+		if s.flowControl && s.credits.Load() <= 0 {
+			queue = nil
+		}
+
+		var evt *XRPCStreamEvent
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				return
+			}
+			evt = e
+		case <-s.creditc:
+			continue
+		case <-s.done:
+			return
+		case <-em.dropping:
+			return
+		case <-idle:
+			// a consumer that hasn't taken its last event yet isn't idle,
+			// so there's no point queueing a ping behind it
+			select {
+			case s.outgoing <- infoEvent(last, InfoPing, "keepalive"):
+			default:
+			}
+			keepalive.Reset(s.keepalive)
+			continue
+		}
+
+		if evt = em.hydrate(s, evt); evt == nil {
+			return
+		}
+
+		if s.flowControl {
+			s.credits.Add(-1)
+		}
+
+		if !em.deliverOne(s, evt, timer, timeout) {
+			return
+		}
+		last = evt
+
+		if keepalive != nil {
+			resetTimer(keepalive, s.keepalive)
+		}
+	}
+}
+
+// deliverOne sends evt to the subscriber, giving up after the send timeout if
+// it has one. It returns false if delivery should stop.
+func (em *EventManager) deliverOne(s *Subscriber, evt *XRPCStreamEvent, timer *time.Timer, timeout <-chan time.Time) bool {
+	select {
+	case s.outgoing <- evt:
+		s.recordDelivery(evt)
+		return true
+	default:
+	}
+
+	if timer != nil {
+		resetTimer(timer, s.sendTimeout)
+	}
+
+	select {
+	case s.outgoing <- evt:
+		s.recordDelivery(evt)
+		return true
+	case <-s.done:
+		return false
+	case <-em.dropping:
+		return false
+	case <-timeout:
+		em.log.Warnw("send to subscriber timed out", "sub", s.id, "name", s.name, "seq", evt.sequence(), "timeout", s.sendTimeout)
+		em.metrics.dropped.WithLabelValues(evt.kind()).Inc()
+		dropped := s.dropped.Add(1)
+		if s.evictAfterOverflows > 0 && dropped >= int64(s.evictAfterOverflows) {
+			reason := fmt.Sprintf("dropped %d events", dropped)
+			em.log.Warnw("evicting slow subscriber", "sub", s.id, "name", s.name, "reason", reason)
+			s.end(ErrConsumerTooSlow(reason))
+			select {
+			case em.ctrlOps <- &Operation{
+				op:  opUnsubscribe,
+				sub: s,
+			}:
+			case <-em.closed:
+			}
+			return false
+		}
+		return true
+	}
+}
+
+// resetTimer restarts t for d, discarding any expiry that hasn't been
+// received yet.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// InfoSequenceGap is the name of the info frame sent to subscribers when
+// gap detection is enabled and an event's seq doesn't directly follow the
+// previous one.
+const InfoSequenceGap = "SequenceGap"
+
+// InfoOutdatedCursor is the name of the info frame sent to subscribers whose
+// cursor is older than the oldest event the persister retains, before
+// playback resumes from the oldest retained event.
+const InfoOutdatedCursor = "OutdatedCursor"
+
+// InfoLiveTail is the name of the info frame sent to subscribers that set
+// SubscribeOpts.LiveTail, marking the point where playback ends and live
+// events begin.
+const InfoLiveTail = "LiveTail"
+
+// InfoPing is the name of the keepalive info frame sent to subscribers that
+// set SubscribeOpts.KeepaliveInterval when their stream goes quiet.
+const InfoPing = "Ping"
+
+// infoEvent builds an info frame for the same stream as evt. Label events get
+// a label info frame, everything else (including a nil evt) a repo one.
+func infoEvent(evt *XRPCStreamEvent, name, msg string) *XRPCStreamEvent {
+	if evt != nil && (evt.LabelLabels != nil || evt.LabelInfo != nil) {
+		return &XRPCStreamEvent{
+			LabelInfo: &label.SubscribeLabels_Info{
+				Name:    name,
+				Message: &msg,
+			},
+		}
+	}
+
+	return &XRPCStreamEvent{
+		RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+			Name:    name,
+			Message: &msg,
+		},
+	}
+}
+
+// Shutdown stops the Run loop and closes the outgoing channel of every
+// registered subscriber. Any goroutines blocked trying to submit operations
+// to the manager are released. Shutdown waits for the operation currently
+// being processed (including its Persist call) to complete, and then for
+// every subscriber's channel to be closed: in ShutdownDrop mode straight
+// away, discarding what is buffered, and in ShutdownDrain mode once its
+// consumer has taken everything it was already handed. If ctx is done first
+// whatever is still buffered is discarded and ctx.Err() returned. It is safe
+// to call Shutdown more than once.
+func (em *EventManager) Shutdown(ctx context.Context) error {
+	em.stop()
+
+	if !em.running.Load() {
+		return nil
+	}
+
+	select {
+	case <-em.runDone:
+	case <-ctx.Done():
+		em.abandon()
+		return ctx.Err()
+	}
+
+	return em.flush(ctx)
+}
+
+type Subscriber struct {
+	// assigned by the run loop on registration
+	id          uint64
+	connectedAt time.Time
+
+	name string
+
+	outgoing chan *XRPCStreamEvent
+
+	// kinds is a mask of the event kinds the subscriber wants, all of them
+	// if zero, checked before filter. filter is nil if there is none; it is
+	// swapped by the run loop but also read by playback, hence atomic.
+	kinds     uint32
+	filter    atomic.Pointer[func(*XRPCStreamEvent) bool]
+	transform func(*XRPCStreamEvent) *XRPCStreamEvent
+
+	// compressBlocks sends commits with zstd compressed Blocks
+	compressBlocks bool
+
+	// resolveTooBig, if set, fetches the blocks of TooBig commits
+	resolveTooBig TooBigResolver
+
+	// liveTail requests an InfoLiveTail frame on going live
+	liveTail bool
+
+	// tail marks a subscriber registered by Tail
+	tail bool
+
+	// with flowControl, credits is the number of events the consumer has
+	// granted but not yet been sent, and creditc is signalled whenever it
+	// grants more
+	flowControl bool
+	credits     atomic.Int64
+	creditc     chan struct{}
+
+	// keepalive is the idle interval after which an InfoPing frame is sent
+	keepalive time.Duration
+
+	// snapshot starts playback from a label snapshot rather than the cursor
+	snapshot bool
+
+	// uids and pds restrict the subscriber to events for these accounts and
+	// routed to these PDS ids, and routeGen is used by the run loop's router
+	uids     map[util.Uid]struct{}
+	pds      []uint
+	routeGen uint64
+
+	done chan struct{}
+
+	// err is why the subscription ended, set once by end before ended and
+	// errc are closed
+	endOnce sync.Once
+	err     error
+	ended   chan struct{}
+	errc    chan error
+
+	// finished is closed once outgoing has been closed
+	finished chan struct{}
+
+	// slow consumer eviction policy, see SubscribeOpts
+	evictAfterOverflows int
+	evictAfterFull      time.Duration
+
+	// unless the manager delivers inline, live events are handed to a
+	// delivery goroutine through queue rather than sent to outgoing by the
+	// run loop. queue then holds the subscriber's buffer and outgoing only
+	// has room for a single event.
+	sendTimeout time.Duration
+	queue       chan *XRPCStreamEvent
+
+	fullSince   time.Time
+	evictReason string
+
+	// fault is set if the subscriber's filter or transform panicked, and
+	// faultReported once that has been logged
+	fault         atomic.Pointer[subscriberFault]
+	faultReported atomic.Bool
+
+	// while a subscriber is catching up on playback, live events are staged
+	// in pending instead of being sent to outgoing. live is only set while
+	// holding lk.
+	lk              sync.Mutex
+	live            atomic.Bool
+	pending         []*XRPCStreamEvent
+	pendingOverflow bool
+
+	// dropped counts events lost to a full buffer, overflows counts the
+	// number of distinct times the buffer filled up
+	dropped   atomic.Int64
+	overflows atomic.Int64
+	lastSeq   atomic.Int64
+
+	// cursor is the last seq played back while catching up, which the
+	// pruning loop must not prune past
+	cursor atomic.Int64
+
+	// utilization is the moving average of the buffer's fill ratio, owned
+	// by the run loop
+	utilization float64
+
+	// delivered is the last event with a seq sent to outgoing, and
+	// deliveredAt when, in unix nanoseconds
+	delivered   atomic.Pointer[XRPCStreamEvent]
+	deliveredAt atomic.Int64
+}
+
+// liveChan is the channel the run loop sends live events to
+func (s *Subscriber) liveChan() chan *XRPCStreamEvent {
+	if s.queue != nil {
+		return s.queue
+	}
+	return s.outgoing
+}
+
+// closeQueue closes the subscriber's delivery queue, which only the run loop
+// does. It holds lk because catch up sends the LiveTail frame on the queue
+// under lk as it goes live, having checked under lk that the subscriber is
+// still wanted.
+func (s *Subscriber) closeQueue() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	close(s.queue)
+}
+
+// liveTailEvent builds the InfoLiveTail frame for a stream whose last
+// delivered event was last, which may be nil.
+func liveTailEvent(last *XRPCStreamEvent) *XRPCStreamEvent {
+	return infoEvent(last, InfoLiveTail, "caught up to the live stream")
+}
+
+// stage buffers evt if the subscriber is still catching up, returning false
+// if it is live and evt should be sent directly. The staging buffer is the
+// same size as the subscriber's buffer; once it fills, further events are dropped and the
+// subscriber replays them from the persister instead.
+func (s *Subscriber) stage(evt *XRPCStreamEvent) bool {
+	if s.live.Load() {
+		return false
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.live.Load() {
+		return false
+	}
+
+	// a coalesced label batch is staged as the batches it was merged from,
+	// so that catch up's seq dedupe drops those playback already sent
+	parts := []*XRPCStreamEvent{evt}
+	if evt.coalesced != nil {
+		parts = evt.coalesced
+	}
+	for _, e := range parts {
+		if len(s.pending) < s.bufferCap() {
+			s.pending = append(s.pending, e)
+		} else {
+			s.pendingOverflow = true
+		}
+	}
+
+	return true
+}
+
+// markSeen records that the subscriber is up to date with seq, either
+// because the event was queued for it or because its filter rejected it.
+func (s *Subscriber) markSeen(seq int64) {
+	if seq != 0 {
+		s.lastSeq.Store(seq)
+	}
+}
+
+// noteOverflow logs and counts an event dropped because the subscriber's
+// buffer was full. Tail subscribers drop events by design, so theirs are only
+// counted in their own stats.
+func (em *EventManager) noteOverflow(s *Subscriber, kind string, seq int64) {
+	if s.tail {
+		return
+	}
+
+	em.log.Warnw("event overflow", "sub", s.id, "name", s.name, "seq", seq, "buffered", s.bufferLen())
+	em.metrics.dropped.WithLabelValues(kind).Inc()
+}
+
+// recordOverflow notes that an event could not be delivered because the
+// outgoing buffer was full. It returns a non-empty reason if the subscriber
+// should be evicted under its policy.
+func (s *Subscriber) recordOverflow() string {
+	dropped := s.dropped.Add(1)
+	if s.fullSince.IsZero() {
+		s.fullSince = time.Now()
+		s.overflows.Add(1)
+	}
+
+	if s.evictAfterOverflows > 0 && dropped >= int64(s.evictAfterOverflows) {
+		return fmt.Sprintf("dropped %d events", dropped)
+	}
+
+	if s.evictAfterFull > 0 {
+		if full := time.Since(s.fullSince); full >= s.evictAfterFull {
+			return fmt.Sprintf("buffer full for %s", full)
+		}
+	}
+
+	return ""
+}
+
+const (
+	EvtKindErrorFrame = -1
+	EvtKindMessage    = 1
+)
+
+// EventHeader precedes every frame on a subscription stream. Op is
+// EvtKindMessage or EvtKindErrorFrame, MsgType names the message type of
+// message frames, and Version is the revision of the frame format the
+// producer wrote, see FrameVersion.
+type EventHeader struct {
+	Op      int64  `cborgen:"op"`
+	MsgType string `cborgen:"t"`
+	Version int64  `cborgen:"v"`
+}
+
+type XRPCStreamEvent struct {
+	Error         *ErrorFrame
+	RepoCommit    *comatproto.SyncSubscribeRepos_Commit
+	RepoHandle    *comatproto.SyncSubscribeRepos_Handle
+	RepoInfo      *comatproto.SyncSubscribeRepos_Info
+	RepoMigrate   *comatproto.SyncSubscribeRepos_Migrate
+	RepoTombstone *comatproto.SyncSubscribeRepos_Tombstone
+	RepoIdentity  *IdentityEvent
+	RepoAccount   *AccountEvent
+	LabelLabels   *label.SubscribeLabels_Labels
+	LabelInfo     *label.SubscribeLabels_Info
+
+	// some private fields for internal routing perf
+	PrivUid         util.Uid `json:"-" cborgen:"-"`
+	PrivPdsId       uint     `json:"-" cborgen:"-"`
+	PrivRelevantPds []uint   `json:"-" cborgen:"-"`
+
+	// coalesced holds the label batches a coalesced batch was merged from
+	coalesced []*XRPCStreamEvent
+}
+
+// sequence returns the seq of whichever sub-event is set, or zero for event
+// kinds that don't carry one.
+func (evt *XRPCStreamEvent) sequence() int64 {
+	switch {
+	case evt.RepoCommit != nil:
+		return evt.RepoCommit.Seq
+	case evt.RepoHandle != nil:
+		return evt.RepoHandle.Seq
+	case evt.RepoMigrate != nil:
+		return evt.RepoMigrate.Seq
+	case evt.RepoTombstone != nil:
+		return evt.RepoTombstone.Seq
+	case evt.RepoIdentity != nil:
+		return evt.RepoIdentity.Seq
+	case evt.RepoAccount != nil:
+		return evt.RepoAccount.Seq
+	case evt.LabelLabels != nil:
+		return evt.LabelLabels.Seq
+	default:
+		return 0
+	}
+}
+
+// hasSequence reports whether the event kind carries a seq field.
+func (evt *XRPCStreamEvent) hasSequence() bool {
+	return evt.RepoCommit != nil ||
+		evt.RepoHandle != nil ||
+		evt.RepoMigrate != nil ||
+		evt.RepoTombstone != nil ||
+		evt.RepoIdentity != nil ||
+		evt.RepoAccount != nil ||
+		evt.LabelLabels != nil
+}
+
+// setSequence stamps seq into whichever sub-event is set. It is a no-op for
+// kinds without a seq field.
+func (evt *XRPCStreamEvent) setSequence(seq int64) {
+	switch {
+	case evt.RepoCommit != nil:
+		evt.RepoCommit.Seq = seq
+	case evt.RepoHandle != nil:
+		evt.RepoHandle.Seq = seq
+	case evt.RepoMigrate != nil:
+		evt.RepoMigrate.Seq = seq
+	case evt.RepoTombstone != nil:
+		evt.RepoTombstone.Seq = seq
+	case evt.RepoIdentity != nil:
+		evt.RepoIdentity.Seq = seq
+	case evt.RepoAccount != nil:
+		evt.RepoAccount.Seq = seq
+	case evt.LabelLabels != nil:
+		evt.LabelLabels.Seq = seq
+	}
+}
+
+// kind returns a short name for the type of event, used to label metrics.
+func (evt *XRPCStreamEvent) kind() string {
+	switch {
+	case evt.Error != nil:
+		return "error"
+	case evt.RepoCommit != nil:
+		return "commit"
+	case evt.RepoHandle != nil:
+		return "handle"
+	case evt.RepoInfo != nil:
+		return "info"
+	case evt.RepoMigrate != nil:
+		return "migrate"
+	case evt.RepoTombstone != nil:
+		return "tombstone"
+	case evt.RepoIdentity != nil:
+		return "identity"
+	case evt.RepoAccount != nil:
+		return "account"
+	case evt.LabelLabels != nil:
+		return "labels"
+	case evt.LabelInfo != nil:
+		return "label_info"
+	default:
+		return "unknown"
+	}
+}
+
+// repoDID returns the DID of the account a repo event is about, or "" for
+// label, info and error frames.
+func (evt *XRPCStreamEvent) repoDID() string {
+	switch {
+	case evt.RepoCommit != nil:
+		return evt.RepoCommit.Repo
+	case evt.RepoHandle != nil:
+		return evt.RepoHandle.Did
+	case evt.RepoMigrate != nil:
+		return evt.RepoMigrate.Did
+	case evt.RepoTombstone != nil:
+		return evt.RepoTombstone.Did
+	case evt.RepoIdentity != nil:
+		return evt.RepoIdentity.Did
+	case evt.RepoAccount != nil:
+		return evt.RepoAccount.Did
+	default:
+		return ""
+	}
+}
+
+// eventTime returns the time an event says it happened: the time field of
+// repo events, or the latest label cts in a label batch. ok is false for
+// other events and for times that are missing or can't be parsed as RFC
+// 3339.
+func (evt *XRPCStreamEvent) eventTime() (t time.Time, ok bool) {
+	var ts string
+	switch {
+	case evt.RepoCommit != nil:
+		ts = evt.RepoCommit.Time
+	case evt.RepoHandle != nil:
+		ts = evt.RepoHandle.Time
+	case evt.RepoMigrate != nil:
+		ts = evt.RepoMigrate.Time
+	case evt.RepoTombstone != nil:
+		ts = evt.RepoTombstone.Time
+	case evt.RepoIdentity != nil:
+		ts = evt.RepoIdentity.Time
+	case evt.RepoAccount != nil:
+		ts = evt.RepoAccount.Time
+	case evt.LabelLabels != nil:
+		for _, l := range evt.LabelLabels.Labels {
+			if lt, err := time.Parse(time.RFC3339, l.Cts); err == nil && lt.After(t) {
+				t, ok = lt, true
+			}
+		}
+		return t, ok
+	default:
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+type ErrorFrame struct {
+	Error   string `cborgen:"error"`
+	Message string `cborgen:"message"`
+}
+
+// Message types for the event kinds defined in this package rather than in
+// the lexicons.
+const (
+	MsgTypeIdentity = "#identity"
+	MsgTypeAccount  = "#account"
+)
+
+// IdentityEvent announces that an account's identity (its handle or DID
+// document) may have changed, so consumers should re-resolve it.
+type IdentityEvent struct {
+	Did    string  `json:"did" cborgen:"did"`
+	Seq    int64   `json:"seq" cborgen:"seq"`
+	Time   string  `json:"time" cborgen:"time"`
+	Handle *string `json:"handle,omitempty" cborgen:"handle,omitempty"`
+}
+
+// AccountEvent announces a change in whether an account is active on the
+// host. Status describes why an inactive account is inactive, e.g.
+// "takendown", "suspended" or "deactivated".
+type AccountEvent struct {
+	Did    string  `json:"did" cborgen:"did"`
+	Seq    int64   `json:"seq" cborgen:"seq"`
+	Time   string  `json:"time" cborgen:"time"`
+	Active bool    `json:"active" cborgen:"active"`
+	Status *string `json:"status,omitempty" cborgen:"status,omitempty"`
+}
+
+// AddEvent submits ev to be persisted and broadcast. Invalid events and, with
+// FailOnPersistError, persist failures are reported as a *StreamError named
+// ErrorInvalidEvent or ErrorPersistFailed, so a producer can relay them in
+// the same terms as an error frame. Info and error frames are submitted at
+// PriorityHigh and everything else at PriorityNormal; see
+// AddEventWithPriority to choose.
+func (em *EventManager) AddEvent(ctx context.Context, ev *XRPCStreamEvent) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEvent")
+	defer span.End()
+
+	return em.addEvent(ctx, ev, defaultPriority(ev), em.failOnPersistError)
+}
+
+// AddEventSync is like AddEvent, but blocks until the event has been
+// persisted and handed to every matching subscriber. It returns any error
+// from the persister, even if the manager went on to broadcast the event.
+func (em *EventManager) AddEventSync(ctx context.Context, ev *XRPCStreamEvent) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEventSync")
+	defer span.End()
+
+	return em.addEvent(ctx, ev, defaultPriority(ev), true)
+}
+
+// addEvent submits ev to the run loop in class pri. If wait is set it blocks until the
+// event has been persisted and broadcast, returning any persist error. If ctx
+// is cancelled before the run loop accepts the event, it is abandoned and
+// ctx's error returned.
+func (em *EventManager) addEvent(ctx context.Context, ev *XRPCStreamEvent, pri Priority, wait bool) error {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("kind", ev.kind()))
+	if err := em.validate(ev); err != nil {
+		return err
+	}
+
+	kept, keys := em.dedupe([]*XRPCStreamEvent{ev})
+	if len(kept) == 0 {
+		em.log.Debugw("dropping duplicate event", "kind", ev.kind(), "seq", ev.sequence())
+		return ErrDuplicateEvent
+	}
+
+	if err := em.throttle(ctx); err != nil {
+		em.forgetDedup(keys)
+		return err
+	}
+
+	if err := em.submit(ctx, &Operation{
+		op:  opSend,
+		evt: ev,
+		pri: pri,
+	}, wait); err != nil {
+		em.forgetDedup(keys)
+		return err
+	}
+
+	return nil
+}
+
+// AddEvents submits a batch of events to the run loop as a single operation.
+// The events are persisted with one PersistBatch call and then broadcast in
+// order, which saves a round trip through the run loop per event for
+// producers such as backfills that emit many events at once. Otherwise it
+// behaves like AddEvent.
+func (em *EventManager) AddEvents(ctx context.Context, evs []*XRPCStreamEvent) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEvents")
+	defer span.End()
+
+	return em.addEvents(ctx, evs, defaultPriority(evs...))
+}
+
+func (em *EventManager) addEvents(ctx context.Context, evs []*XRPCStreamEvent, pri Priority) error {
+	if len(evs) == 0 {
+		return nil
+	}
+
+	for _, ev := range evs {
+		if err := em.validate(ev); err != nil {
+			return err
+		}
+	}
+
+	evs, keys := em.dedupe(evs)
+	if len(evs) == 0 {
+		return ErrDuplicateEvent
+	}
+
+	if err := em.throttle(ctx); err != nil {
+		em.forgetDedup(keys)
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("events", len(evs)))
+	if err := em.submit(ctx, &Operation{
+		op:   opSendBatch,
+		evts: evs,
+		pri:  pri,
+	}, em.failOnPersistError || em.atomicBatches); err != nil {
+		em.forgetDedup(keys)
+		return err
+	}
+
+	return nil
+}
+
+// submit hands op to the run loop, waiting for its result if wait is set.
+// The run loop's spans for op are children of ctx's.
+func (em *EventManager) submit(ctx context.Context, op *Operation, wait bool) error {
+	op.spanCtx = trace.SpanContextFromContext(ctx)
+	if wait {
+		op.result = make(chan error, 1)
+	}
+
+	select {
+	case em.queueFor(op) <- op:
+	case <-em.closed:
+		return fmt.Errorf("event manager shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if !wait {
+		return nil
+	}
+
+	return em.await(op)
+}
+
+// await waits for the run loop to reply to op, which must have a result
+// channel. An op may still be queued when the loop exits, in which case it
+// is never processed.
+func (em *EventManager) await(op *Operation) error {
+	select {
+	case err := <-op.result:
+		return err
+	case <-em.runDone:
+		// the run loop may have finished our op just before exiting
+		select {
+		case err := <-op.result:
+			return err
+		default:
+			return fmt.Errorf("event manager shut down")
+		}
+	}
+}
+
+func (em *EventManager) AddLabelEvent(ctx context.Context, ev *XRPCStreamEvent) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddLabelEvent")
+	defer span.End()
+
+	return em.addEvent(ctx, ev, defaultPriority(ev), em.failOnPersistError)
+}
+
+var ErrPlaybackShutdown = fmt.Errorf("playback shutting down")
+
+// MinSubscriberBufferSize is the smallest outgoing buffer a subscriber may
+// request via SubscribeOpts.
+const MinSubscriberBufferSize = 16
+
+// SubscribeOpts holds optional per-subscriber settings. The zero value uses
+// the event manager defaults.
+type SubscribeOpts struct {
+	// Name is an optional human readable label for the subscriber, such as
+	// "relay-crawler", included in logs and stats.
+	Name string
+
+	// BufferSize is the number of events that may be buffered for the
+	// subscriber before further events are dropped. If zero, the
+	// manager-wide default is used.
+	BufferSize int
+
+	// EvictAfterOverflows, if non-zero, forcibly unsubscribes the subscriber
+	// once this many events have been dropped because its buffer was full.
+	// Its outgoing channel is closed so the consumer can reconnect and replay
+	// from its last cursor.
+	EvictAfterOverflows int
+
+	// EvictAfterFull, if non-zero, evicts the subscriber once its buffer has
+	// stayed full for at least this long.
+	EvictAfterFull time.Duration
+
+	// Transform, if set, is applied to every event that passes the filter,
+	// and its result is sent in the event's place; returning nil skips the
+	// event altogether. It is meant for trimming events down to the parts a
+	// subscriber cares about, see LabelTransform. Transform must not modify
+	// the event it is given, which is shared with other subscribers and
+	// possibly the persister, so it has to copy anything it changes. That
+	// copy is made on the run loop for every broadcast the subscriber
+	// receives, so transforms should return the original event whenever
+	// nothing needs to change. If Transform or the filter panics, the
+	// subscriber is evicted with an ErrorFilterPanicked error and the panic
+	// logged; other subscribers are unaffected.
+	Transform func(*XRPCStreamEvent) *XRPCStreamEvent
+
+	// SendTimeout, if non-zero, bounds how long the subscriber's delivery
+	// goroutine waits for the consumer to take the next event before
+	// dropping it. Without it, delivery waits indefinitely and events are
+	// only dropped once the buffer behind it fills up. Either way other
+	// subscribers are never held up. Dropped events count towards
+	// EvictAfterOverflows.
+	SendTimeout time.Duration
+
+	// PlaybackRate, if non-zero, limits how many events per second are
+	// played back to the subscriber while it catches up from a cursor, so
+	// that a consumer backfilling from far behind can't monopolize the
+	// persister and CPU at the expense of live subscribers. Up to
+	// PlaybackBurst events (by default one second's worth) may be sent
+	// without waiting. Live events are never throttled.
+	PlaybackRate  float64
+	PlaybackBurst int
+
+	// FutureCursorToLive controls what happens when the requested cursor is
+	// ahead of the latest persisted seq. By default the subscriber receives
+	// a single ErrorFutureCursor error frame and its channel is closed; if
+	// set, the cursor is ignored and the subscriber joins at the live tail.
+	FutureCursorToLive bool
+
+	// Last, if non-zero, starts the subscriber with the last this many
+	// events instead of from a cursor: it is resolved to the persister's
+	// latest seq minus Last when subscribing, then played back and tailed
+	// like any other cursor. If fewer events are retained, playback starts
+	// from the oldest one. Seqs are counted rather than events, so a stream
+	// with gaps in its seqs plays back fewer. No cursor may be given.
+	Last int64
+
+	// KeepaliveInterval, if non-zero, sends the subscriber an InfoPing info
+	// frame whenever no event has been delivered to it for this long, so
+	// that connections behind proxies with idle timeouts stay open. Pings
+	// are only sent once the subscriber is live, and are skipped while it
+	// still has an undelivered event. Like SendTimeout, this gives the
+	// subscriber its own delivery goroutine even with InlineDelivery.
+	KeepaliveInterval time.Duration
+
+	// Snapshot starts the subscriber from the persister's current label
+	// state instead of a cursor: it is first sent synthetic label batches
+	// holding the latest label for each (src, uri, val), then any events
+	// persisted since, then live events. The persister must implement
+	// LabelSnapshotter, and no cursor may be given. If the snapshot fails
+	// the subscriber is played back the full history instead.
+	Snapshot bool
+
+	// LiveTail sends the subscriber an InfoLiveTail info frame exactly once,
+	// after playback from the cursor has finished and before the first live
+	// event. Subscribers without a cursor get it as their first event. The
+	// frame is a label info frame if the last event played back was a label
+	// event, and a repo info frame otherwise.
+	LiveTail bool
+
+	// Pds, if set, restricts the subscriber to events routed to one of these
+	// PDS ids, that is events whose PrivPdsId or PrivRelevantPds includes
+	// one of them. Events carrying neither are delivered regardless. The
+	// manager indexes subscribers by PDS id, so live events routed elsewhere
+	// cost a restricted subscriber nothing, not even a filter call. The
+	// routing fields aren't persisted by every persister, and played back
+	// events without them are delivered regardless as well.
+	Pds []uint
+
+	// Uids, if set, restricts the subscriber to repo events for these
+	// accounts, matched on PrivUid, along with info and error frames. Label
+	// batches and repo events without a PrivUid are not delivered. The
+	// manager doesn't derive PrivUid from an event's DID, so tombstones and
+	// other repo events besides commits only reach the subscriber if their
+	// producer set it. As with Pds, live events for other accounts are
+	// skipped without calling the filter, and playback applies the
+	// restriction to whatever PrivUid the persister restores: SQLite always
+	// stores it, DiskPersistence only with PersistRouting, and DbPersistence
+	// only for commits, with PersistRouting. With both Uids and Pds, events
+	// must satisfy both.
+	Uids []util.Uid
+
+	// Kinds, if set, restricts the subscriber to these event kinds (KindCommit
+	// and so on), checked with a bitmask before the filter is called, so
+	// events of other kinds cost nothing. Info and error frames are always
+	// delivered. See also SubscribeKinds.
+	Kinds []int
+
+	// CompressBlocks sends the subscriber commits whose Blocks are zstd
+	// compressed, to be undone with DecompressBlocks, for consumers that
+	// advertised support for it. Compression is applied after Transform,
+	// and each event is only compressed once for all the subscribers that
+	// get it untransformed. The blocks_bytes_total metric counts the bytes
+	// before and after.
+	CompressBlocks bool
+
+	// ResolveTooBig, if set, is called for each commit flagged TooBig the
+	// subscriber is about to be sent, and the commit is delivered with the
+	// blocks it returns and TooBig cleared instead, so the consumer needn't
+	// fetch the repo itself. If it fails the commit is delivered as is.
+	// Resolving happens on the subscriber's delivery goroutine (which,
+	// like SendTimeout, it always gets) or during playback, after Transform,
+	// so it only holds up this subscriber, in order; manager-wide, at most
+	// TooBigConcurrency resolves run at once. The context is cancelled if
+	// the subscriber goes away.
+	ResolveTooBig TooBigResolver
+
+	// FlowControl makes the consumer pace delivery with credits: the
+	// subscriber is sent at most as many events as the consumer has granted
+	// with Subscription.GrantCredits, starting from InitialCredits, and
+	// pauses once they run out. Every frame counts, including info frames
+	// other than keepalive pings, and playback is paced the same way. While
+	// paused, live events wait in the subscriber's buffer, which fills up and
+	// overflows like that of any other slow consumer, so the run loop is
+	// never held up. Like SendTimeout, this gives the subscriber its own
+	// delivery goroutine even with InlineDelivery.
+	FlowControl    bool
+	InitialCredits int
+
+	// tail registers the subscriber as a Tail
+	tail bool
+}
+
+// ErrorFutureCursor is the error frame name sent to subscribers whose cursor
+// is ahead of the stream.
+const ErrorFutureCursor = "FutureCursor"
+
+// isFutureCursor reports whether since is beyond the latest persisted seq.
+func (em *EventManager) isFutureCursor(ctx context.Context, since int64) (bool, error) {
+	latest, err := em.persister.LatestSeq(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return since > latest, nil
+}
+
+// lastCursor returns the cursor that plays back the last n seqs, clamped to
+// the oldest retained event.
+func (em *EventManager) lastCursor(ctx context.Context, n int64) (int64, error) {
+	latest, err := em.persister.LatestSeq(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	earliest, err := em.persister.EarliestSeq(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	since := latest - n
+	if earliest > 0 && since < earliest-1 {
+		since = earliest - 1
+	}
+	if since < 0 {
+		since = 0
+	}
+
+	return since, nil
+}
+
+func (em *EventManager) Subscribe(ctx context.Context, filter func(*XRPCStreamEvent) bool, since *int64) (<-chan *XRPCStreamEvent, func(), error) {
+	return em.SubscribeWithOpts(ctx, filter, since, nil)
+}
+
+func (em *EventManager) SubscribeWithOpts(ctx context.Context, filter func(*XRPCStreamEvent) bool, since *int64, opts *SubscribeOpts) (<-chan *XRPCStreamEvent, func(), error) {
+	sub, err := em.SubscribeHandle(ctx, filter, since, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sub.Events(), sub.Close, nil
+}
+
+// SubscribeHandle is SubscribeWithOpts returning a Subscription, whose filter
+// can be changed while it is live.
+func (em *EventManager) SubscribeHandle(ctx context.Context, filter func(*XRPCStreamEvent) bool, since *int64, opts *SubscribeOpts) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOpts{}
+	}
+
+	kinds, err := kindMask(opts.Kinds)
+	if err != nil {
+		return nil, err
+	}
+
+	pds := append([]uint(nil), opts.Pds...)
+
+	var uids map[util.Uid]struct{}
+	if len(opts.Uids) > 0 {
+		uids = make(map[util.Uid]struct{}, len(opts.Uids))
+		for _, uid := range opts.Uids {
+			uids[uid] = struct{}{}
+		}
+	}
+
+	bufferSize := em.bufferSize
+	if opts.BufferSize != 0 {
+		if opts.BufferSize < MinSubscriberBufferSize {
+			return nil, fmt.Errorf("subscriber buffer size %d is below the minimum of %d", opts.BufferSize, MinSubscriberBufferSize)
+		}
+		bufferSize = opts.BufferSize
+	}
+
+	done := make(chan struct{})
+	sub := &Subscriber{
+		ended:               make(chan struct{}),
+		finished:            make(chan struct{}),
+		errc:                make(chan error, 1),
+		kinds:               kinds,
+		transform:           opts.Transform,
+		compressBlocks:      opts.CompressBlocks,
+		resolveTooBig:       opts.ResolveTooBig,
+		liveTail:            opts.LiveTail,
+		keepalive:           opts.KeepaliveInterval,
+		snapshot:            opts.Snapshot,
+		uids:                uids,
+		pds:                 pds,
+		done:                done,
+		name:                opts.Name,
+		evictAfterOverflows: opts.EvictAfterOverflows,
+		evictAfterFull:      opts.EvictAfterFull,
+		sendTimeout:         opts.SendTimeout,
+		tail:                opts.tail,
+		flowControl:         opts.FlowControl,
+		creditc:             make(chan struct{}, 1),
+	}
+	if opts.InitialCredits < 0 {
+		return nil, fmt.Errorf("invalid number of initial credits %d", opts.InitialCredits)
+	}
+	sub.credits.Store(int64(opts.InitialCredits))
+	if em.inlineDelivery && opts.SendTimeout == 0 && opts.KeepaliveInterval == 0 && opts.ResolveTooBig == nil && !opts.FlowControl {
+		sub.outgoing = make(chan *XRPCStreamEvent, bufferSize)
+	} else {
+		sub.queue = make(chan *XRPCStreamEvent, bufferSize)
+		sub.outgoing = make(chan *XRPCStreamEvent, 1)
+	}
+	sub.setFilter(filter)
+
+	if (since != nil || opts.Snapshot || opts.Last != 0) && !canPlayback(em.persister) {
+		return nil, ErrPlaybackUnsupported
+	}
+
+	if opts.Last != 0 {
+		if since != nil || opts.Snapshot {
+			return nil, fmt.Errorf("subscriptions starting from the last events can't also have a cursor or snapshot")
+		}
+		if opts.Last < 0 {
+			return nil, fmt.Errorf("invalid number of last events %d", opts.Last)
+		}
+		start, err := em.lastCursor(ctx, opts.Last)
+		if err != nil {
+			return nil, fmt.Errorf("resolving cursor for last %d events: %w", opts.Last, err)
+		}
+		since = &start
+	}
+
+	if opts.Snapshot {
+		if since != nil {
+			return nil, fmt.Errorf("snapshot subscriptions can't also have a cursor")
+		}
+		if _, ok := em.persister.(LabelSnapshotter); !ok {
+			return nil, fmt.Errorf("persister %T doesn't support label snapshots", em.persister)
+		}
+
+		// catch up from the snapshot, or from the beginning if it fails
+		var zero int64
+		since = &zero
+	}
+
+	// cleanup is idempotent so that it can safely be both deferred and
+	// called on an error path. Closing done stops playback and delivery for
+	// the subscriber whether or not the run loop has registered it yet; only
+	// registered subscribers need removing from the loop.
+	var registered bool
+	var cleanupOnce sync.Once
+	cleanup := func() {
+		cleanupOnce.Do(func() {
+			close(done)
+			sub.end(nil)
+			if !registered {
+				return
+			}
+
+			select {
+			case em.ctrlOps <- &Operation{
+				op:  opUnsubscribe,
+				sub: sub,
+			}:
+			case <-em.closed:
+			}
+		})
+	}
+
+	if since != nil {
+		future, err := em.isFutureCursor(ctx, *since)
+		if err != nil {
+			em.log.Errorw("checking subscription cursor", "err", err, "since", *since)
+		}
+
+		if future {
+			if !opts.FutureCursorToLive {
+				// the channel is fresh and unregistered, so there is always
+				// room for this and no other writer
+				serr := ErrFutureCursor(*since)
+				sub.outgoing <- serr.Frame()
+				sub.end(serr)
+				em.finish(sub)
+				return &Subscription{em: em, sub: sub, close: cleanup}, nil
+			}
+
+			since = nil
+		}
+	}
+
+	if since != nil {
+		sub.cursor.Store(*since)
+	}
+
+	if since == nil {
+		sub.live.Store(true)
+
+		if sub.liveTail {
+			// nothing can have been sent yet, so there is room
+			sub.liveChan() <- liveTailEvent(nil)
+		}
+	}
+
+	// register before playing back so that live events which arrive while we
+	// catch up are staged rather than missed
+	op := &Operation{
+		op:     opSubscribe,
+		sub:    sub,
+		result: make(chan error, 1),
+	}
+	select {
+	case em.ctrlOps <- op:
+	case <-em.closed:
+		return nil, fmt.Errorf("event manager shut down")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := em.await(op); err != nil {
+		return nil, err
+	}
+	registered = true
+
+	if since != nil {
+		var limiter *rate.Limiter
+		if opts.PlaybackRate > 0 {
+			burst := opts.PlaybackBurst
+			if burst <= 0 {
+				burst = int(math.Ceil(opts.PlaybackRate))
+			}
+			limiter = rate.NewLimiter(rate.Limit(opts.PlaybackRate), burst)
+		}
+
+		go em.catchUp(ctx, sub, *since, limiter)
+	} else if sub.queue != nil {
+		go em.deliver(sub)
+	}
+
+	return &Subscription{em: em, sub: sub, close: cleanup}, nil
+}
+
+// catchUp plays back persisted events after since into the subscriber's
+// outgoing channel, then flushes any live events staged during playback and
+// switches the subscriber to direct live delivery. Events are deduplicated by
+// seq, so anything seen both in playback and live is only delivered once. If
+// the staging buffer overflowed, the dropped events are already persisted, so
+// we simply play back again from the last delivered seq. If the persister no
+// longer has the events right after the cursor, the subscriber is sent an
+// InfoOutdatedCursor frame and playback resumes from the oldest retained
+// event. Snapshot subscribers are first sent the persister's label snapshot,
+// and playback starts after the seq it reflects. If the subscriber asked for
+// it, an InfoLiveTail frame is sent just before it goes live.
+//
+// Until the subscriber is live this goroutine is the only writer to
+// outgoing, and so is responsible for closing it if the manager shuts down.
+func (em *EventManager) catchUp(ctx context.Context, sub *Subscriber, since int64, limiter *rate.Limiter) {
+	cursor := since
+	push := func(e *XRPCStreamEvent) error {
+		if !em.awaitCredit(sub) {
+			return ErrPlaybackShutdown
+		}
+
+		if e = em.hydrate(sub, e); e == nil {
+			return ErrPlaybackShutdown
+		}
+
+		select {
+		case sub.outgoing <- e:
+			sub.recordDelivery(e)
+			return nil
+		case <-sub.done:
+			return ErrPlaybackShutdown
+		case <-em.closed:
+			return ErrPlaybackShutdown
+		}
+	}
+
+	// throttle waits for the playback rate limit, if there is one, giving up
+	// promptly if the subscriber or manager goes away
+	throttle := func() error {
+		if limiter == nil {
+			return nil
+		}
+
+		r := limiter.Reserve()
+		d := r.Delay()
+		if d == 0 {
+			return nil
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-ctx.Done():
+			r.Cancel()
+			return ErrPlaybackShutdown
+		case <-sub.done:
+			r.Cancel()
+			return ErrPlaybackShutdown
+		case <-em.closed:
+			r.Cancel()
+			return ErrPlaybackShutdown
+		}
+	}
+
+	// outdated holds the info message to send ahead of the next event, once
+	// we know which stream it belongs to
+	var outdated string
+	var last *XRPCStreamEvent
+	send := func(e *XRPCStreamEvent) error {
+		// stop walking the persister as soon as the subscriber goes away,
+		// even if the filter would drop everything that's left
+		select {
+		case <-sub.done:
+			return ErrPlaybackShutdown
+		default:
+		}
+		if sub.faulted() {
+			return ErrPlaybackShutdown
+		}
+
+		if seq := e.sequence(); seq != 0 {
+			if seq <= cursor {
+				return nil
+			}
+			cursor = seq
+			sub.cursor.Store(cursor)
+		}
+
+		if outdated != "" {
+			info := infoEvent(e, InfoOutdatedCursor, outdated)
+			outdated = ""
+			if err := push(info); err != nil {
+				return err
+			}
+		}
+
+		// live events were already filtered before they were staged, but
+		// playback comes straight from the persister
+		if !sub.accepts(e) {
+			return nil
+		}
+
+		if e = em.prepare(sub, e, nil); e == nil {
+			return nil
+		}
+
+		last = e
+		return push(e)
+	}
+
+	exit := func() {
+		select {
+		case <-em.closed:
+			em.finish(sub)
+		default:
+			if sub.faulted() {
+				em.abandonPlayback(sub, em.faultErr(sub))
+			}
+		}
+	}
+
+	if sub.snapshot {
+		// every snapshot batch carries the same seq, so they bypass the
+		// dedupe in send; playback then resumes after that seq
+		seq, err := em.persister.(LabelSnapshotter).Snapshot(ctx, func(e *XRPCStreamEvent) error {
+			if !sub.accepts(e) {
+				return nil
+			}
+			if e = em.prepare(sub, e, nil); e == nil {
+				return nil
+			}
+
+			last = e
+			return push(e)
+		})
+		switch {
+		case err != nil && em.playbackCancelled(ctx, sub, err):
+			em.log.Debugw("label snapshot stopped", "err", err, "sub", sub.id)
+			exit()
+			return
+		case err != nil:
+			em.log.Errorw("label snapshot failed, playing back full history", "err", err, "sub", sub.id)
+		default:
+			cursor = seq
+			sub.cursor.Store(cursor)
+		}
+	}
+
+	replay := true
+	for {
+		if replay {
+			earliest, err := em.persister.EarliestSeq(ctx)
+			if err != nil {
+				if em.playbackCancelled(ctx, sub, err) {
+					em.log.Debugw("events playback stopped", "err", err, "sub", sub.id, "cursor", cursor)
+					exit()
+					return
+				}
+				em.log.Errorw("checking oldest retained seq", "err", err, "sub", sub.id)
+			}
+			if earliest > 0 && cursor < earliest-1 {
+				outdated = fmt.Sprintf("cursor %d is older than the oldest retained event %d", cursor, earliest)
+				cursor = earliest - 1
+				sub.cursor.Store(cursor)
+			}
+
+			play := func(e *XRPCStreamEvent) error {
+				if err := throttle(); err != nil {
+					return err
+				}
+				return send(e)
+			}
+
+			if err := em.persister.Playback(ctx, cursor, play); err != nil {
+				if em.playbackCancelled(ctx, sub, err) {
+					em.log.Debugw("events playback stopped", "err", err, "sub", sub.id, "cursor", cursor)
+					exit()
+					return
+				}
+				if errors.Is(err, ErrCursorEvicted) {
+					// more events were evicted since we checked, try again
+					// from the new oldest event
+					continue
+				}
+				// going live now would silently skip the rest of the
+				// playback, so end the subscription for the consumer to
+				// retry from its cursor
+				em.log.Errorw("events playback failed", "err", err, "sub", sub.id, "cursor", cursor)
+				em.abandonPlayback(sub, ErrPlaybackFailed(err))
+				return
+			}
+		}
+
+		sub.lk.Lock()
+		select {
+		case <-em.closed:
+			sub.lk.Unlock()
+			em.finish(sub)
+			return
+		case <-sub.done:
+			sub.lk.Unlock()
+			return
+		default:
+		}
+		if sub.faulted() {
+			sub.lk.Unlock()
+			exit()
+			return
+		}
+
+		batch := sub.pending
+		replay = sub.pendingOverflow
+		sub.pending = nil
+		sub.pendingOverflow = false
+		if len(batch) == 0 && !replay {
+			if sub.liveTail {
+				// the frame has to go out before the run loop can send
+				// live events, so only go live if there's room for it now.
+				// Otherwise wait for room outside the lock, staging any
+				// events that arrive meanwhile, and go round again.
+				info := liveTailEvent(last)
+				select {
+				case sub.liveChan() <- info:
+					sub.liveTail = false
+				default:
+					sub.lk.Unlock()
+					if err := push(info); err != nil {
+						exit()
+						return
+					}
+					sub.liveTail = false
+					continue
+				}
+			}
+
+			sub.live.Store(true)
+			if sub.queue != nil {
+				go em.deliver(sub)
+			}
+			sub.lk.Unlock()
+			return
+		}
+		sub.lk.Unlock()
+
+		for _, e := range batch {
+			if err := send(e); err != nil {
+				exit()
+				return
+			}
+		}
+	}
+}
+
+// playbackCancelled reports whether err, returned by the persister while
+// catching sub up, is only the fallout of the playback being stopped rather
+// than a failure worth reporting. Once the subscriber has gone away or the
+// manager is shutting down any error is expected. A cancelled ctx only
+// explains errors caused by it, so genuine persister failures that happen to
+// coincide with it are still surfaced.
+func (em *EventManager) playbackCancelled(ctx context.Context, sub *Subscriber, err error) bool {
+	if errors.Is(err, ErrPlaybackShutdown) {
+		return true
+	}
+
+	select {
+	case <-sub.done:
+		return true
+	case <-em.closed:
+		return true
+	default:
+	}
+
+	if sub.faulted() {
+		return true
+	}
+
+	if ctx.Err() == nil {
+		return false
+	}
+
+	return errors.Is(err, ctx.Err()) || errors.Is(err, context.Cause(ctx))
+}
+
+var errPlaybackEnd = errors.New("playback reached end of range")
+
+// Playback replays persisted events with seqs in (since, until] to cb, then
+// returns. Unlike Subscribe it never attaches to the live stream, which makes
+// it suitable for exporting or analyzing a fixed window of history. As with
+// Subscribe, since is exclusive: pass the last seq already seen.
+func (em *EventManager) Playback(ctx context.Context, since, until int64, cb func(*XRPCStreamEvent) error) error {
+	if until <= since {
+		return nil
+	}
+
+	err := em.persister.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if e.sequence() > until {
+			return errPlaybackEnd
+		}
+
+		return cb(e)
+	})
+	if errors.Is(err, errPlaybackEnd) {
+		return nil
+	}
+
+	return err
+}
+
+// PlaybackByDID replays the persisted repo events for a single account with
+// seqs after since, using the persister's index where it has one.
+func (em *EventManager) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return em.persister.PlaybackByDID(ctx, did, since, cb)
+}
+
+// PlaybackByTime replays the persisted events whose time falls in [from, to),
+// for forensics over a period rather than from a cursor. See
+// EventPersistence.PlaybackByTime.
+func (em *EventManager) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return em.persister.PlaybackByTime(ctx, from, to, cb)
 }
 
 func (em *EventManager) TakeDownRepo(ctx context.Context, user util.Uid) error {
@@ -0,0 +1,130 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, nsubs := range []int{100, 10000} {
+		for _, inline := range []bool{true, false} {
+			name := fmt.Sprintf("subs=%d/goroutines", nsubs)
+			if inline {
+				name = fmt.Sprintf("subs=%d/inline", nsubs)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				benchmarkBroadcast(b, nsubs, inline)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, nsubs int, inline bool) {
+	ctx := context.Background()
+	em := NewEventManagerWithOpts(NewRingMemPersister(1024), &EventManagerOpts{
+		InlineDelivery: inline,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	for i := 0; i < nsubs; i++ {
+		evts, cleanup, err := em.Subscribe(ctx, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cleanup()
+
+		go func() {
+			for range evts {
+			}
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// AddEventSync returns once the run loop has persisted the event and
+	// handed it to every subscriber, so this measures how long each event
+	// holds up the loop
+	for i := 0; i < b.N; i++ {
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoCommit: &comatproto.SyncSubscribeRepos_Commit{},
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBroadcastRouted compares routing events to per-PDS subscribers by
+// filter alone against the manager's PDS index. Each event is routed to a
+// single PDS, so with the index only that PDS's subscribers are touched.
+func BenchmarkBroadcastRouted(b *testing.B) {
+	const subsPerPds = 10
+	for _, nsubs := range []int{1000, 10000, 50000} {
+		for _, indexed := range []bool{false, true} {
+			name := fmt.Sprintf("subs=%d/filter", nsubs)
+			if indexed {
+				name = fmt.Sprintf("subs=%d/indexed", nsubs)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				benchmarkBroadcastRouted(b, nsubs, nsubs/subsPerPds, indexed)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcastRouted(b *testing.B, nsubs, npds int, indexed bool) {
+	ctx := context.Background()
+	em := NewEventManagerWithOpts(NewRingMemPersister(1024), &EventManagerOpts{
+		InlineDelivery: true,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	for i := 0; i < nsubs; i++ {
+		pds := uint(i%npds) + 1
+
+		var filter func(*XRPCStreamEvent) bool
+		var opts SubscribeOpts
+		if indexed {
+			opts.Pds = []uint{pds}
+		} else {
+			filter = func(evt *XRPCStreamEvent) bool {
+				for _, id := range evt.PrivRelevantPds {
+					if id == pds {
+						return true
+					}
+				}
+				return false
+			}
+		}
+
+		evts, cleanup, err := em.SubscribeWithOpts(ctx, filter, nil, &opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cleanup()
+
+		go func() {
+			for range evts {
+			}
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoCommit:      &comatproto.SyncSubscribeRepos_Commit{},
+			PrivRelevantPds: []uint{uint(i%npds) + 1},
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,1385 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBroadcastOrdering(t *testing.T) {
+	configs := []struct {
+		name string
+		em   EventManagerOpts
+		sub  SubscribeOpts
+	}{
+		{name: "goroutines"},
+		{name: "inline", em: EventManagerOpts{InlineDelivery: true}},
+		{name: "sendtimeout", sub: SubscribeOpts{SendTimeout: time.Minute}},
+		{name: "bufferedops", em: EventManagerOpts{OpsBufferSize: 64}},
+	}
+
+	for _, cfg := range configs {
+		cfg := cfg
+		t.Run(cfg.name, func(t *testing.T) {
+			testBroadcastOrdering(t, cfg.em, cfg.sub)
+		})
+	}
+}
+
+func testBroadcastOrdering(t *testing.T, emOpts EventManagerOpts, subOpts SubscribeOpts) {
+	const (
+		producers = 16
+		perProd   = 250
+		total     = producers * perProd
+		nsubs     = 8
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	emOpts.AssignSeq = true
+	em := NewEventManagerWithOpts(NewMemPersister(), &emOpts)
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	// big enough buffers that nothing is dropped, so any missing event is a
+	// bug rather than backpressure
+	subOpts.BufferSize = total * 2
+
+	var wg sync.WaitGroup
+	errs := make(chan error, nsubs+1+producers)
+
+	consume := func(name string, evts <-chan *XRPCStreamEvent) {
+		defer wg.Done()
+
+		last := int64(-1)
+		for i := 0; i < total; i++ {
+			select {
+			case evt, ok := <-evts:
+				if !ok {
+					errs <- fmt.Errorf("%s: channel closed after %d events", name, i)
+					return
+				}
+
+				seq := evt.sequence()
+				if seq <= last {
+					errs <- fmt.Errorf("%s: seq %d delivered after %d", name, seq, last)
+					return
+				}
+				last = seq
+			case <-ctx.Done():
+				errs <- fmt.Errorf("%s: timed out after %d events", name, i)
+				return
+			}
+		}
+	}
+
+	for i := 0; i < nsubs; i++ {
+		opts := subOpts
+		evts, cleanup, err := em.SubscribeWithOpts(ctx, nil, nil, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		wg.Add(1)
+		go consume(fmt.Sprintf("sub %d", i), evts)
+	}
+
+	var prod sync.WaitGroup
+	start := make(chan struct{})
+	for p := 0; p < producers; p++ {
+		prod.Add(1)
+		go func() {
+			defer prod.Done()
+			<-start
+
+			for i := 0; i < perProd; i++ {
+				if err := em.AddEvent(ctx, &XRPCStreamEvent{
+					RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+
+	// a subscriber joining mid-stream from the beginning must see the
+	// played back events and then the live ones with no reordering across
+	// the handoff
+	time.Sleep(time.Millisecond)
+	since := int64(0)
+	opts := subOpts
+	evts, cleanup, err := em.SubscribeWithOpts(ctx, nil, &since, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	wg.Add(1)
+	go consume("playback", evts)
+
+	prod.Wait()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCleanupImmediatelyAfterSubscribe(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		inline := inline
+		t.Run(fmt.Sprintf("inline=%v", inline), func(t *testing.T) {
+			testCleanupImmediatelyAfterSubscribe(t, inline)
+		})
+	}
+}
+
+func testCleanupImmediatelyAfterSubscribe(t *testing.T, inline bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:      true,
+		InlineDelivery: inline,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	for i := 0; i < 100; i++ {
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keep events flowing so cleanups race with live delivery as well as
+	// with playback
+	stop := make(chan struct{})
+	var prod sync.WaitGroup
+	prod.Add(1)
+	go func() {
+		defer prod.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err := em.AddEvent(ctx, &XRPCStreamEvent{
+				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	baseline := runtime.NumGoroutine()
+
+	cursors := []*int64{nil, new(int64)}
+	future := int64(1 << 40)
+	cursors = append(cursors, &future)
+	mid := int64(50)
+	cursors = append(cursors, &mid)
+
+	for i := 0; i < 200; i++ {
+		since := cursors[i%len(cursors)]
+		subCtx, subCancel := context.WithCancel(ctx)
+		_, cleanup, err := em.SubscribeWithOpts(subCtx, FilterByDIDs("did:plc:nobody"), since, &SubscribeOpts{
+			BufferSize: MinSubscriberBufferSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subCancel()
+		cleanup()
+		// a second call must be harmless
+		cleanup()
+	}
+
+	n, err := em.SubscriberCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d subscribers still registered after cleanup", n)
+	}
+
+	// playback and delivery goroutines exit asynchronously, so give them a
+	// moment before declaring a leak
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if g := runtime.NumGoroutine(); g > baseline {
+		t.Errorf("%d goroutines leaked", g-baseline)
+	}
+
+	close(stop)
+	prod.Wait()
+}
+
+// seqRecorder records the seqs the manager assigned before MemPersister gets
+// a chance to renumber them, and makes LatestSeq slow so that producers have
+// time to pile up behind initialization.
+type seqRecorder struct {
+	*MemPersister
+
+	lk   sync.Mutex
+	seqs []int64
+}
+
+func (p *seqRecorder) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	p.lk.Lock()
+	p.seqs = append(p.seqs, e.sequence())
+	p.lk.Unlock()
+
+	return p.MemPersister.Persist(ctx, e)
+}
+
+func (p *seqRecorder) LatestSeq(ctx context.Context) (int64, error) {
+	time.Sleep(50 * time.Millisecond)
+	return p.MemPersister.LatestSeq(ctx)
+}
+
+func TestInitBeforeProducers(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		buffered := buffered
+		t.Run(fmt.Sprintf("buffered=%v", buffered), func(t *testing.T) {
+			testInitBeforeProducers(t, buffered)
+		})
+	}
+}
+
+func testInitBeforeProducers(t *testing.T, buffered bool) {
+	const (
+		existing  = 10
+		producers = 8
+		perProd   = 50
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// a previous run left some events behind
+	mp := NewMemPersister()
+	for i := 0; i < existing; i++ {
+		if _, err := mp.Persist(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &EventManagerOpts{AssignSeq: true}
+	if buffered {
+		opts.OpsBufferSize = producers * perProd
+	}
+	p := &seqRecorder{MemPersister: mp}
+	em := NewEventManagerWithOpts(p, opts)
+	defer em.Shutdown(ctx)
+
+	// producers start before the manager is initialized, and Init and Run
+	// race each other as well as the producers
+	var wg sync.WaitGroup
+	errs := make(chan error, producers+1)
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perProd; j++ {
+				if err := em.AddEvent(ctx, &XRPCStreamEvent{
+					RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := em.Init(ctx); err != nil {
+			errs <- err
+		}
+	}()
+	go em.Run(ctx)
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// buffered events may not have been persisted yet, but the run loop
+	// takes ops in order, so they have once a query has been answered
+	if _, err := em.SubscriberCount(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if len(p.seqs) != producers*perProd {
+		t.Fatalf("persisted %d events, expected %d", len(p.seqs), producers*perProd)
+	}
+	for i, seq := range p.seqs {
+		if want := int64(existing + i + 1); seq != want {
+			t.Fatalf("event %d was assigned seq %d, expected %d", i, seq, want)
+		}
+	}
+}
+
+// testPersisters makes one of each persister that supports playback.
+func testPersisters() map[string]func(t *testing.T) EventPersistence {
+	return map[string]func(t *testing.T) EventPersistence{
+		"mem":        func(t *testing.T) EventPersistence { return NewMemPersister() },
+		"ring":       func(t *testing.T) EventPersistence { return NewRingMemPersister(100) },
+		"compacting": func(t *testing.T) EventPersistence { return NewCompactingPersistence() },
+		"disk": func(t *testing.T) EventPersistence {
+			p, err := NewDiskPersistence(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { p.Close() })
+			return p
+		},
+		"sqlite": func(t *testing.T) EventPersistence {
+			p, err := NewSQLitePersistence(filepath.Join(t.TempDir(), "events.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		},
+	}
+}
+
+func TestPlaybackSkipsHoles(t *testing.T) {
+	for name, mk := range testPersisters() {
+		mk := mk
+		t.Run(name, func(t *testing.T) {
+			testPlaybackSkipsHoles(t, mk(t))
+		})
+	}
+}
+
+func testPlaybackSkipsHoles(t *testing.T, p EventPersistence) {
+	ctx := context.Background()
+
+	// seqs 1-2, 5-6, 9-11 and everything after 12 were never written
+	seqs := []int64{3, 4, 7, 8, 12}
+	for _, seq := range seqs {
+		if _, err := p.Persist(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+				Seq:    seq,
+				Did:    fmt.Sprintf("did:plc:%d", seq),
+				Handle: "test.example.com",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, since := range []int64{-1, 0, 2, 3, 4, 5, 6, 8, 11, 12, 50} {
+		var want []int64
+		for _, seq := range seqs {
+			if seq > since {
+				want = append(want, seq)
+			}
+		}
+
+		var got []int64
+		if err := p.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+			got = append(got, e.sequence())
+			return nil
+		}); err != nil {
+			t.Fatalf("since %d: %s", since, err)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("since %d: played back %v, expected %v", since, got, want)
+		}
+	}
+
+	// a subscriber whose cursor is in a hole picks up with the next event
+	// and then goes live
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	em := NewEventManager(p)
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	since := int64(5)
+	evts, cleanup, err := em.Subscribe(ctx, nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    20,
+			Did:    "did:plc:20",
+			Handle: "test.example.com",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int64{7, 8, 12, 20} {
+		select {
+		case e := <-evts:
+			if got := e.sequence(); got != want {
+				t.Fatalf("subscriber got seq %d, expected %d", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for seq %d", want)
+		}
+	}
+}
+
+func TestShutdownModes(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		inline := inline
+		t.Run(fmt.Sprintf("inline=%v", inline), func(t *testing.T) {
+			t.Run("drop", func(t *testing.T) {
+				testShutdownDrop(t, inline)
+			})
+			t.Run("drain", func(t *testing.T) {
+				testShutdownDrain(t, inline)
+			})
+			t.Run("drain_deadline", func(t *testing.T) {
+				testShutdownDrainDeadline(t, inline)
+			})
+		})
+	}
+}
+
+// shutdownManager starts a manager and subscribes to it, then adds n events
+// that the subscriber is handed but doesn't take.
+func shutdownManager(t *testing.T, ctx context.Context, mode ShutdownMode, inline bool, n int) (*EventManager, *Subscription) {
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:      true,
+		InlineDelivery: inline,
+		ShutdownMode:   mode,
+	})
+	go em.Run(ctx)
+
+	sub, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:test"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return em, sub
+}
+
+// readAll takes events until the subscription's channel is closed.
+func readAll(t *testing.T, ctx context.Context, sub *Subscription) []int64 {
+	var seqs []int64
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return seqs
+			}
+			seqs = append(seqs, e.sequence())
+		case <-ctx.Done():
+			t.Fatalf("timed out with the channel still open after %v", seqs)
+		}
+	}
+}
+
+func testShutdownDrop(t *testing.T, inline bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, sub := shutdownManager(t, ctx, ShutdownDrop, inline, 5)
+
+	if err := em.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readAll(t, ctx, sub); len(got) != 0 {
+		t.Fatalf("expected buffered events to be dropped, got %v", got)
+	}
+	if sub.Err() != ErrManagerShutdown {
+		t.Fatalf("expected ErrManagerShutdown, got %v", sub.Err())
+	}
+}
+
+func testShutdownDrain(t *testing.T, inline bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, sub := shutdownManager(t, ctx, ShutdownDrain, inline, 5)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- em.Shutdown(ctx)
+	}()
+
+	// Shutdown waits for the consumer
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the buffer was drained: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := readAll(t, ctx, sub); fmt.Sprint(got) != "[1 2 3 4 5]" {
+		t.Fatalf("expected every buffered event, got %v", got)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("shutdown didn't return once the buffer was drained")
+	}
+}
+
+func testShutdownDrainDeadline(t *testing.T, inline bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em, sub := shutdownManager(t, ctx, ShutdownDrain, inline, 5)
+
+	// the consumer takes a couple of events and then stops
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sub.Events():
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer scancel()
+	if err := em.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the drain to hit its deadline, got %v", err)
+	}
+
+	if got := readAll(t, ctx, sub); len(got) != 0 {
+		t.Fatalf("expected events left after the deadline to be dropped, got %v", got)
+	}
+}
+
+// slowPersister makes every Persist take a while, so that operations back up
+// behind the run loop.
+type slowPersister struct {
+	*MemPersister
+	delay time.Duration
+}
+
+func (p *slowPersister) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	time.Sleep(p.delay)
+	return p.MemPersister.Persist(ctx, e)
+}
+
+func TestPriorityLatency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const (
+		flood   = 500
+		trickle = 10
+		delay   = time.Millisecond
+	)
+
+	p := &slowPersister{MemPersister: NewMemPersister(), delay: delay}
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:     true,
+		OpsBufferSize: flood,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	live, err := em.SubscribeHandle(ctx, func(e *XRPCStreamEvent) bool {
+		return e.RepoHandle.Did == "did:plc:live"
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle := func(did string) *XRPCStreamEvent {
+		return &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+				Did:    did,
+				Handle: "test.example.com",
+			},
+		}
+	}
+
+	// a backfill buries the run loop in work that takes flood*delay to get
+	// through
+	for i := 0; i < flood; i++ {
+		if err := em.AddEventWithPriority(ctx, handle("did:plc:backfill"), PriorityLow); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// live events should each wait behind a few of the backfill's at most,
+	// not the whole backlog
+	limit := 20 * delay
+	for i := 0; i < trickle; i++ {
+		start := time.Now()
+		if err := em.AddEventWithPriority(ctx, handle("did:plc:live"), PriorityHigh); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-live.Events():
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for live event %d", i)
+		}
+		if took := time.Since(start); took > limit {
+			t.Fatalf("live event %d took %s to reach the subscriber behind the backfill, expected under %s", i, took, limit)
+		}
+
+		time.Sleep(5 * delay)
+	}
+
+	if em.opsQueued() == 0 {
+		t.Fatal("backfill drained before the live events were done, so they never competed with it")
+	}
+
+	// and the backfill still gets through
+	for {
+		seq, err := p.LatestSeq(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq == flood+trickle {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("backfill stalled at seq %d", seq)
+		}
+	}
+}
+
+// TestPersisterAssignedSeqs has persisters number events while subscribers
+// play them back, which the race detector flags if anything writes an
+// event's seq once the persister holds it.
+func TestPersisterAssignedSeqs(t *testing.T) {
+	for name, mk := range testPersisters() {
+		mk := mk
+		t.Run(name, func(t *testing.T) {
+			testPersisterAssignedSeqs(t, mk(t))
+		})
+	}
+}
+
+func testPersisterAssignedSeqs(t *testing.T, p EventPersistence) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// fewer than the ring persister keeps, so nothing is evicted
+	const n = 50
+
+	em := NewEventManager(p)
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := em.AddEvent(ctx, &XRPCStreamEvent{
+				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+					Did:    fmt.Sprintf("did:plc:%d", i),
+					Handle: "test.example.com",
+				},
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			since := int64(0)
+			sub, err := em.SubscribeHandle(ctx, nil, &since, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer sub.Close()
+
+			var last int64
+			for last < n {
+				select {
+				case e := <-sub.Events():
+					if seq := e.sequence(); seq != last+1 {
+						t.Errorf("got seq %d after %d", seq, last)
+						return
+					}
+					last++
+				case <-ctx.Done():
+					t.Errorf("timed out after seq %d", last)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestCatchUpHandoff has live events arrive while a subscriber is still
+// playing back, and checks it gets every event exactly once, in order, across
+// the switch from playback to the live stream.
+func TestCatchUpHandoff(t *testing.T) {
+	for name, mk := range testPersisters() {
+		mk := mk
+		t.Run(name, func(t *testing.T) {
+			for _, inline := range []bool{false, true} {
+				// a buffer much smaller than the live events sent during
+				// playback overflows staging, so catch up has to replay them
+				for _, buffer := range []int{0, MinSubscriberBufferSize} {
+					inline, buffer := inline, buffer
+					t.Run(fmt.Sprintf("inline=%v/buffer=%d", inline, buffer), func(t *testing.T) {
+						testCatchUpHandoff(t, mk(t), inline, buffer)
+					})
+				}
+			}
+		})
+	}
+}
+
+func testCatchUpHandoff(t *testing.T, p EventPersistence, inline bool, buffer int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// stays under what the ring persister keeps
+	const before, during = 40, 40
+
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:      true,
+		InlineDelivery: inline,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	add := func(i int) error {
+		return em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+				Did:    fmt.Sprintf("did:plc:%d", i),
+				Handle: "test.example.com",
+			},
+		})
+	}
+
+	for i := 0; i < before; i++ {
+		if err := add(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// slow playback down so the live events below land in the middle of it
+	since := int64(0)
+	sub, err := em.SubscribeHandle(ctx, nil, &since, &SubscribeOpts{
+		BufferSize:    buffer,
+		PlaybackRate:  2000,
+		PlaybackBurst: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	produced := make(chan error, 1)
+	go func() {
+		for i := before; i < before+during; i++ {
+			if err := add(i); err != nil {
+				produced <- err
+				return
+			}
+			time.Sleep(200 * time.Microsecond)
+		}
+		produced <- nil
+	}()
+
+	var got []int64
+	for len(got) < before+during {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				t.Fatalf("subscription closed after %v: %v", got, sub.Err())
+			}
+			if seq := e.sequence(); seq != 0 {
+				got = append(got, seq)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out with %v", got)
+		}
+	}
+	if err := <-produced; err != nil {
+		t.Fatal(err)
+	}
+
+	for i, seq := range got {
+		if seq != int64(i+1) {
+			t.Fatalf("expected seqs 1 to %d without gaps or repeats, got %v", before+during, got)
+		}
+	}
+
+	// and nothing is repeated after the handoff either
+	if err := add(before + during); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case e := <-sub.Events():
+			seq := e.sequence()
+			if seq == 0 {
+				continue
+			}
+			if seq != before+during+1 {
+				t.Fatalf("expected seq %d after the handoff, got %d", before+during+1, seq)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the event after the handoff")
+		}
+	}
+}
+
+// TestReplayedTombstoneUids plays tombstones back from disk to a subscriber
+// restricted by uid, which only gets those whose producer set PrivUid.
+func TestReplayedTombstoneUids(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	p, err := NewDiskPersistenceWithOpts(dir, &DiskOpts{PersistRouting: true, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tomb := range []struct {
+		did string
+		uid util.Uid
+	}{
+		{"did:plc:alice", 7},
+		{"did:plc:bob", 8},
+		{"did:plc:alice", 0},
+	} {
+		if _, err := p.Persist(ctx, &XRPCStreamEvent{
+			RepoTombstone: &comatproto.SyncSubscribeRepos_Tombstone{Did: tomb.did, Time: "2024-01-01T00:00:00Z"},
+			PrivUid:       tomb.uid,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewDiskPersistenceWithOpts(dir, &DiskOpts{PersistRouting: true, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	em := NewEventManager(p)
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	since := int64(0)
+	sub, err := em.SubscribeHandle(ctx, nil, &since, &SubscribeOpts{Uids: []util.Uid{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, takeSeqs(t, ctx, sub, 1), 1, 1)
+}
+
+// TestPersistRouting reopens persisters and checks that replayed events
+// carry their routing fields only if PersistRouting was set.
+func TestPersistRouting(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		routing bool
+		open    func(t *testing.T, dir string, routing bool) (EventPersistence, func())
+		wantUid util.Uid
+	}{
+		{"disk", true, openRoutingDisk, 7},
+		{"disk without routing", false, openRoutingDisk, 0},
+		{"sqlite", true, openRoutingSQLite, 7},
+		// sqlite always keeps the uid
+		{"sqlite without routing", false, openRoutingSQLite, 7},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+
+			p, closep := tc.open(t, dir, tc.routing)
+			if _, err := p.Persist(ctx, &XRPCStreamEvent{
+				RepoHandle:      &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:alice", Handle: "alice.test", Time: "2024-01-01T00:00:00Z"},
+				PrivUid:         7,
+				PrivPdsId:       3,
+				PrivRelevantPds: []uint{3, 5},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			closep()
+
+			p, closep = tc.open(t, dir, tc.routing)
+			defer closep()
+
+			var got []*XRPCStreamEvent
+			if err := p.Playback(ctx, 0, func(e *XRPCStreamEvent) error {
+				got = append(got, e)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 event played back, got %d", len(got))
+			}
+
+			e := got[0]
+			wantPds, wantRelevant := uint(0), 0
+			if tc.routing {
+				wantPds, wantRelevant = 3, 2
+			}
+			if e.PrivUid != tc.wantUid || e.PrivPdsId != wantPds || len(e.PrivRelevantPds) != wantRelevant {
+				t.Fatalf("expected uid %d, pds %d and %d relevant pds, got %d, %d and %v", tc.wantUid, wantPds, wantRelevant, e.PrivUid, e.PrivPdsId, e.PrivRelevantPds)
+			}
+			if tc.routing && (e.PrivRelevantPds[0] != 3 || e.PrivRelevantPds[1] != 5) {
+				t.Fatalf("expected relevant pds [3 5], got %v", e.PrivRelevantPds)
+			}
+		})
+	}
+}
+
+func openRoutingDisk(t *testing.T, dir string, routing bool) (EventPersistence, func()) {
+	p, err := NewDiskPersistenceWithOpts(dir, &DiskOpts{PersistRouting: routing, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, func() { p.Close() }
+}
+
+func openRoutingSQLite(t *testing.T, dir string, routing bool) (EventPersistence, func()) {
+	p := openSQLiteWithOpts(t, filepath.Join(dir, "events.db"), &SQLiteOpts{PersistRouting: routing})
+	return p, func() {}
+}
+
+func TestLabelSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{AssignSeq: true})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	add := func(evt *XRPCStreamEvent) {
+		t.Helper()
+		if err := em.AddEventSync(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lbl := func(uri, val, cts string, neg bool) *XRPCStreamEvent {
+		return &XRPCStreamEvent{LabelLabels: &label.SubscribeLabels_Labels{
+			Labels: []*label.Label{{Src: "did:plc:labeler", Uri: uri, Val: val, Cts: cts, Neg: neg}},
+		}}
+	}
+
+	add(lbl("at://did:plc:a/p/1", "spam", "t1", false))
+	add(lbl("at://did:plc:a/p/2", "nsfw", "t1", false))
+	add(lbl("at://did:plc:a/p/1", "spam", "t2", true))
+	add(lbl("at://did:plc:a/p/2", "nsfw", "t3", false))
+	add(lbl("at://did:plc:a/p/3", "gore", "t1", false))
+	add(&XRPCStreamEvent{RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:a", Handle: "a.test"}})
+
+	sub, err := em.SubscribeHandle(ctx, nil, nil, &SubscribeOpts{Snapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the negated label is left out and the relabelled one appears once,
+	// at its latest, with the batch covering every event persisted so far
+	snap := takeEvents(t, ctx, sub, 1)[0].LabelLabels
+	if snap == nil || len(snap.Labels) != 2 {
+		t.Fatalf("expected a snapshot batch of 2 labels, got %+v", snap)
+	}
+	if l := snap.Labels[0]; l.Uri != "at://did:plc:a/p/2" || l.Cts != "t3" {
+		t.Fatalf("expected the latest nsfw label first, got %+v", l)
+	}
+	if l := snap.Labels[1]; l.Uri != "at://did:plc:a/p/3" || l.Val != "gore" {
+		t.Fatalf("expected the gore label second, got %+v", l)
+	}
+	if snap.Seq != 6 {
+		t.Fatalf("expected the snapshot to carry seq 6, got %d", snap.Seq)
+	}
+
+	// and then the subscriber tails the stream
+	add(lbl("at://did:plc:a/p/4", "spam", "t4", false))
+	if live := takeEvents(t, ctx, sub, 1)[0]; live.sequence() != 7 || live.LabelLabels.Labels[0].Uri != "at://did:plc:a/p/4" {
+		t.Fatalf("expected the live label at seq 7, got %+v", live.LabelLabels)
+	}
+}
+
+// failThirdBatch fails the third event persisted in any batch transaction.
+type failThirdBatch struct {
+	*MemPersister
+}
+
+type failThirdTx struct {
+	BatchTx
+	n int
+}
+
+func (p *failThirdBatch) BeginBatch(ctx context.Context) (BatchTx, error) {
+	tx, err := p.MemPersister.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &failThirdTx{BatchTx: tx}, nil
+}
+
+func (tx *failThirdTx) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	if tx.n++; tx.n == 3 {
+		return 0, fmt.Errorf("third event refused")
+	}
+	return tx.BatchTx.Persist(ctx, e)
+}
+
+func TestAtomicBatches(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := &failThirdBatch{MemPersister: NewMemPersister()}
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:     true,
+		AtomicBatches: true,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	sub, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := func(n int) []*XRPCStreamEvent {
+		evts := make([]*XRPCStreamEvent, n)
+		for i := range evts {
+			evts[i] = &XRPCStreamEvent{
+				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:a", Handle: "a.test"},
+			}
+		}
+		return evts
+	}
+
+	// the third event fails, so none of the five are stored or broadcast
+	if err := em.AddEvents(ctx, batch(5)); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	if seq, err := p.LatestSeq(ctx); err != nil || seq != 0 {
+		t.Fatalf("expected the failed batch to be rolled back, got latest seq %d (%v)", seq, err)
+	}
+	takeSeqs(t, ctx, sub, 0)
+
+	// and its seqs are handed out again to the next batch
+	if err := em.AddEvents(ctx, batch(2)); err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, takeSeqs(t, ctx, sub, 2), 1, 2)
+	if seq, err := p.LatestSeq(ctx); err != nil || seq != 2 {
+		t.Fatalf("expected latest seq 2, got %d (%v)", seq, err)
+	}
+}
+
+func TestPruneRespectsCursors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := &pausedPlayback{
+		MemPersister: NewMemPersister(),
+		upTo:         3,
+		paused:       make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	em := NewEventManagerWithOpts(p, &EventManagerOpts{
+		AssignSeq:  true,
+		RetainSeqs: 2,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	var once sync.Once
+	release := func() { once.Do(func() { close(p.release) }) }
+	defer release()
+
+	add := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:a", Handle: "a.test"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(3)
+
+	since := int64(0)
+	sub, err := em.SubscribeHandle(ctx, nil, &since, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, takeSeqs(t, ctx, sub, 3), 1, 3)
+	select {
+	case <-p.paused:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for playback")
+	}
+
+	// the subscriber is still catching up from seq 3 as more events arrive
+	add(7)
+
+	prune := func(wantPruned, wantFloor int64) {
+		t.Helper()
+		before := testutil.ToFloat64(em.metrics.pruned)
+		if err := em.prune(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		if n := testutil.ToFloat64(em.metrics.pruned) - before; n != float64(wantPruned) {
+			t.Fatalf("expected %d events pruned, got %v", wantPruned, n)
+		}
+		if floor := testutil.ToFloat64(em.metrics.retentionFloor); floor != float64(wantFloor) {
+			t.Fatalf("expected retention floor %d, got %v", wantFloor, floor)
+		}
+	}
+
+	// the catching-up subscriber holds the floor at its cursor rather than
+	// the retention window
+	prune(3, 4)
+
+	release()
+	expectSeqs(t, takeSeqs(t, ctx, sub, 7), 4, 10)
+
+	// once it's live only RetainSeqs are kept
+	prune(5, 9)
+
+	got := 0
+	if err := p.MemPersister.Playback(ctx, 8, func(*XRPCStreamEvent) error {
+		got++
+		return nil
+	}); err != nil || got != 2 {
+		t.Fatalf("expected seqs 9 and 10 to remain, got %d (%v)", got, err)
+	}
+}
+
+func TestSubscriberCompressBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{AssignSeq: true})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	plain, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zstd []*Subscription
+	for i := 0; i < 2; i++ {
+		sub, err := em.SubscribeHandle(ctx, nil, nil, &SubscribeOpts{CompressBlocks: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		zstd = append(zstd, sub)
+	}
+
+	blocks := bytes.Repeat([]byte("blocks "), 1000)
+	if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+		RepoCommit: &comatproto.SyncSubscribeRepos_Commit{Repo: "did:plc:alice", Blocks: blocks},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := takeEvents(t, ctx, plain, 1)[0]; !bytes.Equal(e.RepoCommit.Blocks, blocks) {
+		t.Fatal("expected the plain subscriber to get the blocks as they were")
+	}
+
+	var compressed int
+	for _, sub := range zstd {
+		e := takeEvents(t, ctx, sub, 1)[0]
+		if bytes.Equal(e.RepoCommit.Blocks, blocks) {
+			t.Fatal("expected compressed blocks")
+		}
+		compressed = len(e.RepoCommit.Blocks)
+
+		got, err := DecompressBlocks(e.RepoCommit.Blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, blocks) {
+			t.Fatal("expected the blocks back after decompressing")
+		}
+	}
+
+	// the commit is compressed once for both subscribers
+	if raw := testutil.ToFloat64(em.metrics.blocksBytes.WithLabelValues("raw")); raw != float64(len(blocks)) {
+		t.Fatalf("expected %d raw bytes compressed, got %v", len(blocks), raw)
+	}
+	if n := testutil.ToFloat64(em.metrics.blocksBytes.WithLabelValues("zstd")); n != float64(compressed) {
+		t.Fatalf("expected %d compressed bytes, got %v", compressed, n)
+	}
+}
+
+func TestResolveTooBig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:         true,
+		TooBigConcurrency: 1,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	blocks := []byte("resolved blocks")
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	resolve := func(ctx context.Context, commit *comatproto.SyncSubscribeRepos_Commit) ([]byte, error) {
+		entered <- struct{}{}
+		select {
+		case <-release:
+			return blocks, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	plain, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolving []*Subscription
+	for i := 0; i < 2; i++ {
+		sub, err := em.SubscribeHandle(ctx, nil, nil, &SubscribeOpts{ResolveTooBig: resolve})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolving = append(resolving, sub)
+	}
+
+	if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+		RepoCommit: &comatproto.SyncSubscribeRepos_Commit{Repo: "did:plc:alice", TooBig: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// with a concurrency of 1 the second resolve waits for the first
+	<-entered
+	select {
+	case <-entered:
+		t.Fatal("second resolve ran alongside the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if e := takeEvents(t, ctx, plain, 1)[0]; !e.RepoCommit.TooBig || len(e.RepoCommit.Blocks) != 0 {
+		t.Fatal("expected the subscriber without a resolver to get the commit as it was")
+	}
+	for _, sub := range resolving {
+		e := takeEvents(t, ctx, sub, 1)[0]
+		if e.RepoCommit.TooBig || !bytes.Equal(e.RepoCommit.Blocks, blocks) {
+			t.Fatalf("expected the resolved blocks with TooBig cleared, got %q (TooBig %v)", e.RepoCommit.Blocks, e.RepoCommit.TooBig)
+		}
+	}
+}
+
+func TestPressureThrottle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:                 true,
+		InlineDelivery:            true,
+		UtilizationSampleInterval: 5 * time.Millisecond,
+		ThrottleAbove:             0.5,
+		MaxThrottleDelay:          200 * time.Millisecond,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	sub, err := em.SubscribeHandle(ctx, nil, nil, &SubscribeOpts{BufferSize: MinSubscriberBufferSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func() time.Duration {
+		t.Helper()
+		start := time.Now()
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:a", Handle: "a.test"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	waitPressure := func(want float64) {
+		t.Helper()
+		for em.Pressure() != want {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for pressure %v, at %v", want, em.Pressure())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// a subscriber three quarters full puts producers halfway between
+	// ThrottleAbove and 1
+	for i := 0; i < 12; i++ {
+		add()
+	}
+	waitPressure(0.75)
+	if d := add(); d < 100*time.Millisecond {
+		t.Fatalf("expected the producer to be held back 100ms, took %v", d)
+	}
+
+	// and once it drains they aren't held back at all
+	expectSeqs(t, takeSeqs(t, ctx, sub, 13), 1, 13)
+	waitPressure(0)
+	if n := testutil.ToFloat64(em.metrics.pressure); n != 0 {
+		t.Fatalf("expected the pressure gauge to be back at 0, got %v", n)
+	}
+}
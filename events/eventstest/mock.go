@@ -0,0 +1,269 @@
+// Package eventstest provides test doubles for code built on the events
+// package.
+package eventstest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/util"
+)
+
+// MockPersistence is an in-memory events.EventPersistence for tests. It
+// stores and plays back events like events.MemPersister, and additionally
+// records every event persisted through it, can be primed with events to
+// play back without recording them, and can be made to fail Persist or
+// Playback. It is safe for concurrent use.
+type MockPersistence struct {
+	mem *events.MemPersister
+
+	lk        sync.Mutex
+	persisted []*events.XRPCStreamEvent
+	seqs      []int64
+	changed   chan struct{}
+
+	persistErr    error
+	playbackErr   error
+	playbackAfter int
+
+	playbacks []int64
+}
+
+var _ events.EventPersistence = (*MockPersistence)(nil)
+
+func NewMockPersistence() *MockPersistence {
+	return &MockPersistence{
+		mem:     events.NewMemPersister(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Prime stores evts for playback without recording them as persisted, as
+// if they had been persisted before the test started. Events without a seq
+// are numbered after the last one stored.
+func (m *MockPersistence) Prime(evts ...*events.XRPCStreamEvent) {
+	for _, e := range evts {
+		if _, err := m.mem.Persist(context.Background(), e); err != nil {
+			panic(fmt.Sprintf("priming mock persistence: %s", err))
+		}
+	}
+}
+
+// FailPersist makes every following Persist return err, without storing or
+// recording the event. A nil err makes Persist succeed again.
+func (m *MockPersistence) FailPersist(err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.persistErr = err
+}
+
+// FailPlayback makes every following playback return err before calling cb.
+// A nil err makes playback succeed again.
+func (m *MockPersistence) FailPlayback(err error) {
+	m.FailPlaybackAfter(0, err)
+}
+
+// FailPlaybackAfter makes every following playback return err once it has
+// called cb with n events, or after calling it with all of them if there are
+// fewer, to exercise failures part way through a replay.
+func (m *MockPersistence) FailPlaybackAfter(n int, err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.playbackErr = err
+	m.playbackAfter = n
+}
+
+// Persisted returns the events persisted so far, in the order they were
+// persisted, not counting primed events.
+func (m *MockPersistence) Persisted() []*events.XRPCStreamEvent {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return append([]*events.XRPCStreamEvent(nil), m.persisted...)
+}
+
+// PersistedSeqs returns the seqs of the events persisted so far, in the
+// order they were persisted.
+func (m *MockPersistence) PersistedSeqs() []int64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return append([]int64(nil), m.seqs...)
+}
+
+// Playbacks returns the cursor of each call to Playback and PlaybackByDID so
+// far, in order. PlaybackByTime calls are recorded with a cursor of -1.
+func (m *MockPersistence) Playbacks() []int64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return append([]int64(nil), m.playbacks...)
+}
+
+// WaitPersisted waits until at least n events have been persisted, so tests
+// needn't sleep for events added asynchronously.
+func (m *MockPersistence) WaitPersisted(ctx context.Context, n int) error {
+	for {
+		m.lk.Lock()
+		have, changed := len(m.persisted), m.changed
+		m.lk.Unlock()
+
+		if have >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d persisted events, have %d: %w", n, have, ctx.Err())
+		}
+	}
+}
+
+// AssertPersistedSeqs fails the test unless exactly the events with seqs
+// want have been persisted, in that order.
+func (m *MockPersistence) AssertPersistedSeqs(t testing.TB, want ...int64) {
+	t.Helper()
+
+	got := m.PersistedSeqs()
+	if len(got) != len(want) {
+		t.Fatalf("persisted seqs %v, expected %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("persisted seqs %v, expected %v", got, want)
+		}
+	}
+}
+
+// AwaitPersistedSeqs waits up to timeout for len(want) events to be
+// persisted and then asserts their seqs as AssertPersistedSeqs does.
+func (m *MockPersistence) AwaitPersistedSeqs(t testing.TB, timeout time.Duration, want ...int64) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := m.WaitPersisted(ctx, len(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	m.AssertPersistedSeqs(t, want...)
+}
+
+func (m *MockPersistence) Persist(ctx context.Context, e *events.XRPCStreamEvent) (int64, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.persistErr != nil {
+		return 0, m.persistErr
+	}
+
+	seq, err := m.mem.Persist(ctx, e)
+	if err != nil {
+		return 0, err
+	}
+
+	m.persisted = append(m.persisted, e)
+	m.seqs = append(m.seqs, seq)
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	return seq, nil
+}
+
+func (m *MockPersistence) PersistBatch(ctx context.Context, es []*events.XRPCStreamEvent) error {
+	for _, e := range es {
+		if _, err := m.Persist(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BeginBatch returns a batch that persists each event immediately, so it
+// can't be rolled back.
+func (m *MockPersistence) BeginBatch(ctx context.Context) (events.BatchTx, error) {
+	return &mockBatch{m}, nil
+}
+
+type mockBatch struct {
+	m *MockPersistence
+}
+
+func (b *mockBatch) Persist(ctx context.Context, e *events.XRPCStreamEvent) (int64, error) {
+	return b.m.Persist(ctx, e)
+}
+
+func (b *mockBatch) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (b *mockBatch) Rollback(ctx context.Context) error {
+	return events.ErrRollbackUnsupported
+}
+
+// playback records a playback from since and wraps cb to fail as configured.
+func (m *MockPersistence) playback(since int64, cb func(*events.XRPCStreamEvent) error) (func(*events.XRPCStreamEvent) error, func(error) error) {
+	m.lk.Lock()
+	m.playbacks = append(m.playbacks, since)
+	failErr, after := m.playbackErr, m.playbackAfter
+	m.lk.Unlock()
+
+	if failErr == nil {
+		return cb, func(err error) error { return err }
+	}
+
+	var n int
+	wrapped := func(e *events.XRPCStreamEvent) error {
+		if n >= after {
+			return failErr
+		}
+		n++
+		return cb(e)
+	}
+
+	// the stored events may run out before the failure point
+	finish := func(err error) error {
+		if err == nil {
+			return failErr
+		}
+		return err
+	}
+
+	return wrapped, finish
+}
+
+func (m *MockPersistence) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	cb, finish := m.playback(since, cb)
+	return finish(m.mem.Playback(ctx, since, cb))
+}
+
+func (m *MockPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	cb, finish := m.playback(since, cb)
+	return finish(m.mem.PlaybackByDID(ctx, did, since, cb))
+}
+
+func (m *MockPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*events.XRPCStreamEvent) error) error {
+	cb, finish := m.playback(-1, cb)
+	return finish(m.mem.PlaybackByTime(ctx, from, to, cb))
+}
+
+func (m *MockPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	return m.mem.TakeDownRepo(ctx, usr)
+}
+
+func (m *MockPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	return m.mem.EarliestSeq(ctx)
+}
+
+func (m *MockPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	return m.mem.LatestSeq(ctx)
+}
@@ -0,0 +1,157 @@
+package eventstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func handleEvent(seq int64) *events.XRPCStreamEvent {
+	return &events.XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    seq,
+			Did:    fmt.Sprintf("did:plc:%d", seq),
+			Handle: "test.example.com",
+		},
+	}
+}
+
+func TestMockRecordsPersists(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mp := NewMockPersistence()
+	em := events.NewEventManager(mp)
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, handleEvent(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mp.AwaitPersistedSeqs(t, 5*time.Second, 1, 2, 3)
+
+	boom := errors.New("boom")
+	mp.FailPersist(boom)
+	if err := em.AddEventSync(ctx, handleEvent(0)); err == nil {
+		t.Fatal("expected persist failure to be reported")
+	}
+	mp.AssertPersistedSeqs(t, 1, 2, 3)
+}
+
+func TestMockPrimedPlayback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mp := NewMockPersistence()
+	mp.Prime(handleEvent(4), handleEvent(5), handleEvent(9))
+
+	em := events.NewEventManager(mp)
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	since := int64(4)
+	evts, cleanup, err := em.Subscribe(ctx, nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for _, want := range []int64{5, 9} {
+		select {
+		case e := <-evts:
+			if e.RepoHandle == nil || e.RepoHandle.Seq != want {
+				t.Fatalf("expected seq %d, got %+v", want, e)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for seq %d", want)
+		}
+	}
+
+	if got := mp.Persisted(); len(got) != 0 {
+		t.Fatalf("primed events recorded as persisted: %d", len(got))
+	}
+	if got := mp.Playbacks(); len(got) == 0 || got[0] != 4 {
+		t.Fatalf("expected a playback from 4, got %v", got)
+	}
+}
+
+func TestMockPlaybackFailure(t *testing.T) {
+	ctx := context.Background()
+
+	mp := NewMockPersistence()
+	mp.Prime(handleEvent(1), handleEvent(2), handleEvent(3))
+
+	boom := errors.New("boom")
+	for _, tc := range []struct {
+		after int
+		want  []int64
+	}{
+		{0, nil},
+		{2, []int64{1, 2}},
+		{5, []int64{1, 2, 3}},
+	} {
+		mp.FailPlaybackAfter(tc.after, boom)
+
+		var got []int64
+		err := mp.Playback(ctx, 0, func(e *events.XRPCStreamEvent) error {
+			got = append(got, e.RepoHandle.Seq)
+			return nil
+		})
+		if !errors.Is(err, boom) {
+			t.Fatalf("after %d: expected injected error, got %v", tc.after, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("after %d: played back %v, expected %v", tc.after, got, tc.want)
+		}
+	}
+
+	mp.FailPlayback(nil)
+	var n int
+	if err := mp.Playback(ctx, 0, func(e *events.XRPCStreamEvent) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events once playback was fixed, got %d", n)
+	}
+}
+
+func TestMockPlaybackFailureEndsSubscription(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mp := NewMockPersistence()
+	mp.Prime(handleEvent(1), handleEvent(2))
+	mp.FailPlayback(errors.New("disk on fire"))
+
+	em := events.NewEventManager(mp)
+	go em.Run(ctx)
+	defer em.Shutdown(ctx)
+
+	since := int64(0)
+	sub, err := em.SubscribeHandle(ctx, nil, &since, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	select {
+	case err := <-sub.Errors():
+		var serr *events.StreamError
+		if !errors.As(err, &serr) || serr.Name != events.ErrorPlaybackFailed {
+			t.Fatalf("expected a playback failure, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the subscription to end")
+	}
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+func exportHandle(seq int64, did string) *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    seq,
+			Did:    did,
+			Handle: "test.example.com",
+			Time:   "2024-01-01T00:00:00Z",
+		},
+	}
+}
+
+// memSeqs plays back everything in p.
+func memSeqs(t *testing.T, p *MemPersister) []int64 {
+	var seqs []int64
+	if err := p.Playback(context.Background(), 0, func(e *XRPCStreamEvent) error {
+		seqs = append(seqs, e.sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestExportImport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{AssignSeq: true})
+	go src.Run(ctx)
+	defer src.Shutdown(context.Background())
+
+	for i := 0; i < 3; i++ {
+		if err := src.AddEventSync(ctx, exportHandle(0, "did:plc:alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dump bytes.Buffer
+	if err := src.Export(ctx, 0, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewMemPersister()
+	dst := NewEventManager(p)
+	if err := dst.Import(ctx, bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, memSeqs(t, p), 1, 3)
+
+	// importing the dump again runs into the events already there
+	err := dst.Import(ctx, bytes.NewReader(dump.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("expected the import to stop at line 1, got %v", err)
+	}
+	if err := dst.ImportWithOpts(ctx, bytes.NewReader(dump.Bytes()), &ImportOpts{SkipOutOfOrder: true}); err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, memSeqs(t, p), 1, 3)
+
+	record := func(rec ExportRecord) string {
+		b, err := json.Marshal(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b) + "\n"
+	}
+
+	// records that don't match their event, or hold an invalid one, stop the
+	// import at their line after the good records before them
+	for _, tc := range []struct {
+		name string
+		bad  ExportRecord
+		is   error
+	}{
+		{"mismatched seq", ExportRecord{Seq: 9, Kind: "handle", Event: exportHandle(6, "did:plc:alice")}, nil},
+		{"invalid event", ExportRecord{Seq: 6, Kind: "handle", Event: exportHandle(6, "alice")}, ErrInvalidEvent},
+	} {
+		p := NewMemPersister()
+		dst := NewEventManager(p)
+		in := record(ExportRecord{Seq: 4, Kind: "handle", Event: exportHandle(4, "did:plc:alice")}) +
+			record(ExportRecord{Seq: 5, Kind: "handle", Event: exportHandle(5, "did:plc:alice")}) +
+			record(tc.bad)
+
+		err := dst.Import(ctx, strings.NewReader(in))
+		if err == nil || !strings.Contains(err.Error(), "line 3") {
+			t.Fatalf("%s: expected the import to stop at line 3, got %v", tc.name, err)
+		}
+		if tc.is != nil && !errors.Is(err, tc.is) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.is, err)
+		}
+		expectSeqs(t, memSeqs(t, p), 4, 5)
+	}
+}
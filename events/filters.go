@@ -0,0 +1,260 @@
+package events
+
+import (
+	"strings"
+
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+// FilterByDIDs returns a subscription filter that matches events concerning
+// any of the given DIDs. For repo events this is the repo (or account) DID;
+// for label events it matches if any label's subject URI belongs to one of
+// the DIDs. Stream-level frames that don't refer to an account (info and
+// error frames) always pass.
+func FilterByDIDs(dids ...string) func(*XRPCStreamEvent) bool {
+	set := make(map[string]struct{}, len(dids))
+	for _, d := range dids {
+		set[d] = struct{}{}
+	}
+
+	has := func(did string) bool {
+		_, ok := set[did]
+		return ok
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		switch {
+		case evt.RepoCommit != nil:
+			return has(evt.RepoCommit.Repo)
+		case evt.RepoHandle != nil:
+			return has(evt.RepoHandle.Did)
+		case evt.RepoMigrate != nil:
+			return has(evt.RepoMigrate.Did)
+		case evt.RepoTombstone != nil:
+			return has(evt.RepoTombstone.Did)
+		case evt.RepoIdentity != nil:
+			return has(evt.RepoIdentity.Did)
+		case evt.RepoAccount != nil:
+			return has(evt.RepoAccount.Did)
+		case evt.LabelLabels != nil:
+			for _, l := range evt.LabelLabels.Labels {
+				if l != nil && has(subjectDID(l.Uri)) {
+					return true
+				}
+			}
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+// subjectDID extracts the account DID from a label subject, which is either
+// a bare DID or an at:// URI.
+func subjectDID(uri string) string {
+	uri = strings.TrimPrefix(uri, "at://")
+	if i := strings.IndexByte(uri, '/'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	return uri
+}
+
+// FilterByCollections returns a subscription filter that matches commits
+// containing at least one op on a record in any of the given collections
+// (NSIDs, e.g. "app.bsky.feed.post"). An op path has the form
+// "<collection>/<rkey>"; everything before the first slash is taken as the
+// collection.
+//
+// Commits flagged TooBig always pass, since their op list may be incomplete
+// and consumers need to see them to decide whether to fetch the full repo.
+// Info and error frames always pass; other repo and label events are
+// rejected.
+func FilterByCollections(nsids ...string) func(*XRPCStreamEvent) bool {
+	set := make(map[string]struct{}, len(nsids))
+	for _, n := range nsids {
+		set[n] = struct{}{}
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		switch {
+		case evt.RepoCommit != nil:
+			if evt.RepoCommit.TooBig {
+				return true
+			}
+
+			for _, op := range evt.RepoCommit.Ops {
+				if op == nil {
+					continue
+				}
+				if _, ok := set[pathCollection(op.Path)]; ok {
+					return true
+				}
+			}
+			return false
+		case evt.Error != nil, evt.RepoInfo != nil, evt.LabelInfo != nil:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// pathCollection returns the collection component of a repo op path.
+func pathCollection(path string) string {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+
+	return path
+}
+
+// FilterTombstones returns a subscription filter that matches only repo
+// tombstones, for consumers that just need to know when to drop all state for
+// a deleted repo. Combine it with FilterByDIDs to watch specific repos. Info
+// and error frames always pass.
+func FilterTombstones() func(*XRPCStreamEvent) bool {
+	return func(evt *XRPCStreamEvent) bool {
+		return evt.RepoTombstone != nil || evt.Error != nil || evt.RepoInfo != nil || evt.LabelInfo != nil
+	}
+}
+
+// LabelTransform returns a SubscribeOpts.Transform that trims label batches
+// down to the labels accepted by keep. Batches where every label is kept are
+// passed through as is, batches where none are kept are skipped, and anything
+// else is replaced by a copy holding only the kept labels. Other events pass
+// through unchanged.
+func LabelTransform(keep func(*label.Label) bool) func(*XRPCStreamEvent) *XRPCStreamEvent {
+	return func(evt *XRPCStreamEvent) *XRPCStreamEvent {
+		if evt.LabelLabels == nil {
+			return evt
+		}
+
+		labels := evt.LabelLabels.Labels
+		n := 0
+		for _, l := range labels {
+			if l != nil && keep(l) {
+				n++
+			}
+		}
+
+		switch n {
+		case 0:
+			return nil
+		case len(labels):
+			return evt
+		}
+
+		trimmed := make([]*label.Label, 0, n)
+		for _, l := range labels {
+			if l != nil && keep(l) {
+				trimmed = append(trimmed, l)
+			}
+		}
+
+		out := *evt
+		out.LabelLabels = &label.SubscribeLabels_Labels{
+			LexiconTypeID: evt.LabelLabels.LexiconTypeID,
+			Seq:           evt.LabelLabels.Seq,
+			Labels:        trimmed,
+		}
+		return &out
+	}
+}
+
+// LabelsFromSources matches labels created by any of the given labelers.
+func LabelsFromSources(srcs ...string) func(*label.Label) bool {
+	set := make(map[string]struct{}, len(srcs))
+	for _, s := range srcs {
+		set[s] = struct{}{}
+	}
+
+	return func(l *label.Label) bool {
+		_, ok := set[l.Src]
+		return ok
+	}
+}
+
+// LabelsWithValues matches labels with any of the given values.
+func LabelsWithValues(vals ...string) func(*label.Label) bool {
+	set := make(map[string]struct{}, len(vals))
+	for _, v := range vals {
+		set[v] = struct{}{}
+	}
+
+	return func(l *label.Label) bool {
+		_, ok := set[l.Val]
+		return ok
+	}
+}
+
+// All returns a filter that matches only if every given filter matches.
+// Filters are evaluated in order and evaluation stops at the first
+// rejection. With no filters, everything matches.
+func All(filters ...func(*XRPCStreamEvent) bool) func(*XRPCStreamEvent) bool {
+	fs := compactFilters(filters)
+	switch len(fs) {
+	case 0:
+		return func(*XRPCStreamEvent) bool { return true }
+	case 1:
+		return fs[0]
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		for _, f := range fs {
+			if !f(evt) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any returns a filter that matches if at least one of the given filters
+// matches. Evaluation stops at the first match. With no filters, nothing
+// matches.
+func Any(filters ...func(*XRPCStreamEvent) bool) func(*XRPCStreamEvent) bool {
+	fs := compactFilters(filters)
+	switch len(fs) {
+	case 0:
+		return func(*XRPCStreamEvent) bool { return false }
+	case 1:
+		return fs[0]
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		for _, f := range fs {
+			if f(evt) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not inverts a filter, except that stream-level frames (info and error
+// frames) always pass, as they do through FilterByDIDs, so that
+// Not(FilterByDIDs(...)) doesn't cut the subscriber off from them. A nil
+// filter, which elsewhere accepts every event, inverts to one that rejects
+// everything but those frames.
+func Not(f func(*XRPCStreamEvent) bool) func(*XRPCStreamEvent) bool {
+	return func(evt *XRPCStreamEvent) bool {
+		if !evt.hasSequence() {
+			return true
+		}
+		return f != nil && !f(evt)
+	}
+}
+
+// compactFilters copies filters, dropping nil entries, so the returned
+// combinator isn't affected by later changes to the caller's slice.
+func compactFilters(filters []func(*XRPCStreamEvent) bool) []func(*XRPCStreamEvent) bool {
+	out := make([]func(*XRPCStreamEvent) bool, 0, len(filters))
+	for _, f := range filters {
+		if f != nil {
+			out = append(out, f)
+		}
+	}
+
+	return out
+}
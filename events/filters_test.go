@@ -0,0 +1,37 @@
+package events
+
+import (
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+func TestNotPassesStreamFrames(t *testing.T) {
+	repo := func(did string) *XRPCStreamEvent {
+		return &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: did, Handle: "test.example.com"},
+		}
+	}
+	info := &XRPCStreamEvent{RepoInfo: &comatproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"}}
+	errFrame := &XRPCStreamEvent{Error: &ErrorFrame{Error: "FutureCursor"}}
+
+	for _, tc := range []struct {
+		name   string
+		filter func(*XRPCStreamEvent) bool
+		evt    *XRPCStreamEvent
+		want   bool
+	}{
+		{"excluded repo", Not(FilterByDIDs("did:plc:a")), repo("did:plc:a"), false},
+		{"other repo", Not(FilterByDIDs("did:plc:a")), repo("did:plc:b"), true},
+		{"info frame", Not(FilterByDIDs("did:plc:a")), info, true},
+		{"error frame", Not(FilterByDIDs("did:plc:a")), errFrame, true},
+		{"info frame rejected by inner", Not(func(*XRPCStreamEvent) bool { return true }), info, true},
+		{"nil rejects repo events", Not(nil), repo("did:plc:a"), false},
+		{"nil passes info frames", Not(nil), info, true},
+		{"double negation", Not(Not(FilterByDIDs("did:plc:a"))), repo("did:plc:b"), false},
+	} {
+		if got := tc.filter(tc.evt); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	label "github.com/bluesky-social/indigo/api/label"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// FrameVersion is the revision of the frame format MarshalFrames writes in
+// EventHeader.Version. Headers from producers that predate the field have no
+// version, which reads as 0 and means the same format as version 1.
+//
+// New event kinds get a new MsgType rather than a new version, and new
+// fields are only ever added to existing kinds, so any reader can handle
+// frames of any version: it decodes the kinds it knows, ignoring fields it
+// doesn't, and skips the rest. UnmarshalFrames reports skipped frames with
+// ErrUnknownFrame, and HandleRepoStream passes over them, so adding a kind
+// never breaks existing consumers. The version only goes up for a change
+// that old readers would misread, which readers can then refuse.
+const FrameVersion = 1
+
+// ErrUnknownFrame is wrapped by the error UnmarshalFrames returns for a
+// frame with an op or message type it doesn't know, after consuming its
+// body. Readers should skip such frames rather than treat them as fatal.
+var ErrUnknownFrame = errors.New("unknown frame")
+
+// MarshalFrames writes the event as it is sent on a subscription stream: a
+// CBOR EventHeader followed by the CBOR body of whichever sub-event is set.
+// Error frames get an EvtKindErrorFrame header, everything else an
+// EvtKindMessage header naming the message type. The header carries
+// FrameVersion.
+func (evt *XRPCStreamEvent) MarshalFrames(w io.Writer) error {
+	header := EventHeader{Op: EvtKindMessage, Version: FrameVersion}
+	var obj lexutil.CBOR
+
+	switch {
+	case evt.Error != nil:
+		header.Op = EvtKindErrorFrame
+		obj = evt.Error
+	case evt.RepoCommit != nil:
+		header.MsgType = "#commit"
+		obj = evt.RepoCommit
+	case evt.RepoHandle != nil:
+		header.MsgType = "#handle"
+		obj = evt.RepoHandle
+	case evt.RepoInfo != nil:
+		header.MsgType = "#info"
+		obj = evt.RepoInfo
+	case evt.RepoMigrate != nil:
+		header.MsgType = "#migrate"
+		obj = evt.RepoMigrate
+	case evt.RepoTombstone != nil:
+		header.MsgType = "#tombstone"
+		obj = evt.RepoTombstone
+	case evt.RepoIdentity != nil:
+		header.MsgType = MsgTypeIdentity
+		obj = evt.RepoIdentity
+	case evt.RepoAccount != nil:
+		header.MsgType = MsgTypeAccount
+		obj = evt.RepoAccount
+	case evt.LabelLabels != nil:
+		header.MsgType = "#labels"
+		obj = evt.LabelLabels
+	case evt.LabelInfo != nil:
+		header.MsgType = "#info"
+		obj = evt.LabelInfo
+	default:
+		return fmt.Errorf("unrecognized event kind")
+	}
+
+	if err := header.MarshalCBOR(w); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	if err := obj.MarshalCBOR(w); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	return nil
+}
+
+// UnmarshalFrames reads an event written by MarshalFrames into evt. Repo and
+// label streams both use "#info" for their info frames, which are decoded as
+// RepoInfo; the two have the same fields. Frames of any version are read the
+// same way, and those of unknown op or message type are skipped over,
+// leaving evt empty, with an error wrapping ErrUnknownFrame.
+func (evt *XRPCStreamEvent) UnmarshalFrames(r io.Reader) error {
+	var header EventHeader
+	if err := header.UnmarshalCBOR(r); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	switch header.Op {
+	case EvtKindErrorFrame:
+		evt.Error = new(ErrorFrame)
+		return evt.Error.UnmarshalCBOR(r)
+	case EvtKindMessage:
+	default:
+		return skipFrame(r, header)
+	}
+
+	switch header.MsgType {
+	case "#commit":
+		evt.RepoCommit = new(comatproto.SyncSubscribeRepos_Commit)
+		return evt.RepoCommit.UnmarshalCBOR(r)
+	case "#handle":
+		evt.RepoHandle = new(comatproto.SyncSubscribeRepos_Handle)
+		return evt.RepoHandle.UnmarshalCBOR(r)
+	case "#info":
+		evt.RepoInfo = new(comatproto.SyncSubscribeRepos_Info)
+		return evt.RepoInfo.UnmarshalCBOR(r)
+	case "#migrate":
+		evt.RepoMigrate = new(comatproto.SyncSubscribeRepos_Migrate)
+		return evt.RepoMigrate.UnmarshalCBOR(r)
+	case "#tombstone":
+		evt.RepoTombstone = new(comatproto.SyncSubscribeRepos_Tombstone)
+		return evt.RepoTombstone.UnmarshalCBOR(r)
+	case MsgTypeIdentity:
+		evt.RepoIdentity = new(IdentityEvent)
+		return evt.RepoIdentity.UnmarshalCBOR(r)
+	case MsgTypeAccount:
+		evt.RepoAccount = new(AccountEvent)
+		return evt.RepoAccount.UnmarshalCBOR(r)
+	case "#labels":
+		evt.LabelLabels = new(label.SubscribeLabels_Labels)
+		return evt.LabelLabels.UnmarshalCBOR(r)
+	default:
+		return skipFrame(r, header)
+	}
+}
+
+// skipFrame consumes the body of a frame UnmarshalFrames doesn't know, so a
+// reader of concatenated frames can carry on with the next one.
+func skipFrame(r io.Reader, header EventHeader) error {
+	if err := cbg.ScanForLinks(r, func(cid.Cid) {}); err != nil {
+		return fmt.Errorf("skipping body of unknown frame: %w", err)
+	}
+
+	return fmt.Errorf("%w: op %d, type %q, version %d", ErrUnknownFrame, header.Op, header.MsgType, header.Version)
+}
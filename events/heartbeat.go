@@ -0,0 +1,38 @@
+package events
+
+import (
+	"strconv"
+
+	label "github.com/bluesky-social/indigo/api/label"
+)
+
+// InfoCursor is the name of the heartbeat info frame sent to every live
+// subscriber each EventManagerOpts.CursorHeartbeatInterval, carrying the seq
+// of the latest event broadcast as its message.
+const InfoCursor = "Cursor"
+
+// heartbeat sends every live subscriber an InfoCursor frame with the latest
+// seq. The frame bypasses the subscriber's event kinds, account and PDS
+// restrictions and filter, so a consumer whose own last seq trails the
+// heartbeat knows it is behind rather than just filtering everything out. A
+// subscriber whose buffer is full already has events to catch up on, so it
+// is skipped rather than overflowed. It must be called from the run loop.
+func (em *EventManager) heartbeat() {
+	// heartbeats go out on whichever stream the manager is carrying
+	var stream *XRPCStreamEvent
+	if em.labelStream {
+		stream = &XRPCStreamEvent{LabelInfo: &label.SubscribeLabels_Info{}}
+	}
+	hb := infoEvent(stream, InfoCursor, strconv.FormatInt(em.lastSeq, 10))
+
+	for _, s := range em.subs {
+		if !s.live.Load() {
+			continue
+		}
+
+		select {
+		case s.liveChan() <- hb:
+		default:
+		}
+	}
+}
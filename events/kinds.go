@@ -0,0 +1,91 @@
+package events
+
+import (
+	"context"
+	"fmt"
+)
+
+// Event kinds for SubscribeKinds and SubscribeOpts.Kinds, one for each of the
+// XRPCStreamEvent fields carrying stream content. Unlike EvtKindMessage and
+// EvtKindErrorFrame, which are stream header ops, these say which field is
+// set.
+const (
+	KindCommit = iota
+	KindHandle
+	KindMigrate
+	KindTombstone
+	KindIdentity
+	KindAccount
+	KindLabels
+
+	numKinds
+)
+
+// kindBit returns the bit for evt's kind in a subscriber's kind mask, or zero
+// for info and error frames, which aren't subject to it.
+func (evt *XRPCStreamEvent) kindBit() uint32 {
+	var k int
+	switch {
+	case evt.RepoCommit != nil:
+		k = KindCommit
+	case evt.RepoHandle != nil:
+		k = KindHandle
+	case evt.RepoMigrate != nil:
+		k = KindMigrate
+	case evt.RepoTombstone != nil:
+		k = KindTombstone
+	case evt.RepoIdentity != nil:
+		k = KindIdentity
+	case evt.RepoAccount != nil:
+		k = KindAccount
+	case evt.LabelLabels != nil:
+		k = KindLabels
+	default:
+		return 0
+	}
+
+	return 1 << k
+}
+
+// kindMask builds the mask for a set of kinds. No kinds means all of them.
+func kindMask(kinds []int) (uint32, error) {
+	var mask uint32
+	for _, k := range kinds {
+		if k < 0 || k >= numKinds {
+			return 0, fmt.Errorf("unknown event kind %d", k)
+		}
+		mask |= 1 << k
+	}
+
+	return mask, nil
+}
+
+// accepts reports whether evt passes the subscriber's kind mask, its PDS and
+// account restrictions, and its filter, in that order, so events ruled out by
+// the cheaper checks never reach the filter. The router already skips
+// subscribers for live events routed elsewhere, but playback relies on the
+// restrictions being checked here.
+func (s *Subscriber) accepts(evt *XRPCStreamEvent) bool {
+	if s.kinds != 0 {
+		if bit := evt.kindBit(); bit != 0 && s.kinds&bit == 0 {
+			return false
+		}
+	}
+
+	if len(s.pds) > 0 && !routedTo(s.pds, evt) {
+		return false
+	}
+
+	if len(s.uids) > 0 && !forUids(s.uids, evt) {
+		return false
+	}
+
+	filter := s.filter.Load()
+	return filter == nil || s.callFilter(*filter, evt)
+}
+
+// SubscribeKinds subscribes to events of the given kinds (KindCommit and so
+// on) without a filter function. Info and error frames are delivered too.
+func (em *EventManager) SubscribeKinds(ctx context.Context, kinds []int, since *int64) (<-chan *XRPCStreamEvent, func(), error) {
+	return em.SubscribeWithOpts(ctx, nil, since, &SubscribeOpts{Kinds: kinds})
+}
@@ -0,0 +1,177 @@
+package events
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type eventManagerMetrics struct {
+	broadcast         *prometheus.CounterVec
+	dropped           *prometheus.CounterVec
+	persistErrors     *prometheus.CounterVec
+	subscribers       prometheus.Gauge
+	rejectedSubs      prometheus.Counter
+	broadcastDuration *prometheus.HistogramVec
+	opsQueued         prometheus.GaugeFunc
+	pruned            prometheus.Counter
+	retentionFloor    prometheus.Gauge
+	breakerState      prometheus.Gauge
+	blocksBytes       *prometheus.CounterVec
+	pressure          prometheus.Gauge
+	filterPanics      prometheus.Counter
+	subscriberLag     *subscriberLagCollector
+}
+
+// newEventManagerMetrics builds the manager's collectors. opsQueued reports
+// the current depth of the ops buffers when scraped.
+func newEventManagerMetrics(opsQueued func() float64) *eventManagerMetrics {
+	return &eventManagerMetrics{
+		broadcast: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "broadcast_total",
+			Help:      "Total number of events broadcast to subscribers",
+		}, []string{"kind"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "dropped_total",
+			Help:      "Total number of events dropped because a subscriber buffer was full",
+		}, []string{"kind"}),
+		persistErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "persist_errors_total",
+			Help:      "Total number of events that failed to persist",
+		}, []string{"kind"}),
+		subscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "subscribers",
+			Help:      "Number of currently registered subscribers",
+		}),
+		rejectedSubs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "subscriptions_rejected_total",
+			Help:      "Total number of subscriptions rejected because the subscriber limit was reached",
+		}),
+		broadcastDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "broadcast_duration_seconds",
+			Help:      "Time taken to fan an event out to all subscribers",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"kind"}),
+		opsQueued: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "ops_queued",
+			Help:      "Number of operations waiting in the buffers for the run loop",
+		}, opsQueued),
+		pruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "pruned_total",
+			Help:      "Total number of events pruned from the persister",
+		}),
+		retentionFloor: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "retention_floor",
+			Help:      "Lowest seq kept by the most recent prune",
+		}),
+		breakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "persist_breaker_state",
+			Help:      "State of the persist circuit breaker: 0 closed, 1 open, 2 half open",
+		}),
+		blocksBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "blocks_bytes_total",
+			Help:      "Total size of commit blocks compressed for subscribers, before (raw) and after (zstd) compression",
+		}, []string{"encoding"}),
+		pressure: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "pressure",
+			Help:      "Highest buffer utilization among live subscribers, as reported by Pressure",
+		}),
+		filterPanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "indigo",
+			Subsystem: "events",
+			Name:      "filter_panics_total",
+			Help:      "Total number of subscribers evicted because their filter or transform panicked",
+		}),
+	}
+}
+
+func (m *eventManagerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.broadcast,
+		m.dropped,
+		m.persistErrors,
+		m.subscribers,
+		m.rejectedSubs,
+		m.broadcastDuration,
+		m.opsQueued,
+		m.pruned,
+		m.retentionFloor,
+		m.breakerState,
+		m.blocksBytes,
+		m.pressure,
+		m.filterPanics,
+		m.subscriberLag,
+	}
+}
+
+// subscriberLagCollector reports each named subscriber's delivery lag when
+// scraped, so the delivery path only has to record what it sent. Subscribers
+// sharing a name are reported by the worst of their lags.
+type subscriberLagCollector struct {
+	lags func() map[string]deliveryLag
+
+	seqLag *prometheus.Desc
+	delay  *prometheus.Desc
+}
+
+func newSubscriberLagCollector(lags func() map[string]deliveryLag) *subscriberLagCollector {
+	return &subscriberLagCollector{
+		lags: lags,
+		seqLag: prometheus.NewDesc(
+			"indigo_events_subscriber_seq_lag",
+			"Number of seqs between the latest event broadcast and the last event delivered to the subscriber",
+			[]string{"subscriber"}, nil,
+		),
+		delay: prometheus.NewDesc(
+			"indigo_events_subscriber_delivery_delay_seconds",
+			"Time between the last event delivered to the subscriber being created and its delivery",
+			[]string{"subscriber"}, nil,
+		),
+	}
+}
+
+func (c *subscriberLagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.seqLag
+	ch <- c.delay
+}
+
+func (c *subscriberLagCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, l := range c.lags() {
+		ch <- prometheus.MustNewConstMetric(c.seqLag, prometheus.GaugeValue, float64(l.seq), name)
+		ch <- prometheus.MustNewConstMetric(c.delay, prometheus.GaugeValue, l.delay.Seconds(), name)
+	}
+}
+
+// RegisterMetrics registers the event manager's Prometheus collectors with
+// reg. Metrics are labeled by event kind or subscriber name where applicable.
+func (em *EventManager) RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range em.metrics.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
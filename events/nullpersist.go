@@ -0,0 +1,67 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// NullPersistence discards every event, for ephemeral deployments that only
+// need live fan-out. Nothing can be played back, so the event manager rejects
+// subscriptions with a cursor. It is used when NewEventManager is given a nil
+// persister.
+type NullPersistence struct{}
+
+// ErrPlaybackUnsupported is returned by Subscribe when a cursor is given but
+// the persister doesn't retain events.
+var ErrPlaybackUnsupported error = &StreamError{
+	Name:    ErrorPlaybackUnsupported,
+	Message: "playback is not supported: events are not persisted",
+}
+
+// canPlayback reports whether p retains events to play back.
+func canPlayback(p EventPersistence) bool {
+	switch p.(type) {
+	case NullPersistence, *NullPersistence:
+		return false
+	default:
+		return true
+	}
+}
+
+func (NullPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	return e.sequence(), nil
+}
+
+func (NullPersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return nil
+}
+
+func (p NullPersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	return &nonTxBatch{p}, nil
+}
+
+func (NullPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (NullPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (NullPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (NullPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	return nil
+}
+
+func (NullPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (NullPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	return 0, nil
+}
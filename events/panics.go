@@ -0,0 +1,85 @@
+package events
+
+import (
+	"runtime/debug"
+)
+
+// subscriberFault records the first panic in a subscriber's filter or
+// transform. Both are arbitrary code run on the run loop and by playback, so
+// a panic is recovered and only costs that subscriber its subscription.
+type subscriberFault struct {
+	what  string
+	value interface{}
+	stack []byte
+}
+
+// recoverFault is deferred around calls into the subscriber's code. It faults
+// s if the call panicked, reporting whether it did.
+func (s *Subscriber) recoverFault(what string, r interface{}) bool {
+	if r == nil {
+		return false
+	}
+
+	s.fault.CompareAndSwap(nil, &subscriberFault{
+		what:  what,
+		value: r,
+		stack: debug.Stack(),
+	})
+	return true
+}
+
+// callFilter runs filter on evt, treating a panic as a rejection.
+func (s *Subscriber) callFilter(filter func(*XRPCStreamEvent) bool, evt *XRPCStreamEvent) (ok bool) {
+	defer func() {
+		if s.recoverFault("filter", recover()) {
+			ok = false
+		}
+	}()
+
+	return filter(evt)
+}
+
+// callTransform runs the subscriber's transform on evt, treating a panic as
+// skipping the event.
+func (s *Subscriber) callTransform(evt *XRPCStreamEvent) (out *XRPCStreamEvent) {
+	defer func() {
+		if s.recoverFault("transform", recover()) {
+			out = nil
+		}
+	}()
+
+	return s.transform(evt)
+}
+
+func (s *Subscriber) faulted() bool {
+	return s.fault.Load() != nil
+}
+
+// faultErr reports s's fault, the first time it is called, and returns the
+// error to end the subscription with.
+func (em *EventManager) faultErr(s *Subscriber) error {
+	f := s.fault.Load()
+	if s.faultReported.CompareAndSwap(false, true) {
+		em.log.Errorw("evicting subscriber whose "+f.what+" panicked", "sub", s.id, "name", s.name, "panic", f.value, "stack", string(f.stack))
+		em.metrics.filterPanics.Inc()
+	}
+
+	return ErrFilterPanicked(f.what)
+}
+
+// evictFaulted evicts a registered subscriber that faulted during a
+// broadcast. Only the run loop calls it. A subscriber still catching up is
+// left for catchUp to close, once it notices the fault.
+func (em *EventManager) evictFaulted(s *Subscriber) {
+	s.end(em.faultErr(s))
+	em.removeSub(s)
+	if s.queue != nil {
+		return
+	}
+
+	s.lk.Lock()
+	if s.live.Load() {
+		em.finish(s)
+	}
+	s.lk.Unlock()
+}
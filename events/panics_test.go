@@ -0,0 +1,135 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFilterPanicEvictsSubscriber(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		for _, mode := range []string{"filter", "transform", "playback"} {
+			inline, mode := inline, mode
+			t.Run(fmt.Sprintf("inline=%v/%s", inline, mode), func(t *testing.T) {
+				testFilterPanic(t, inline, mode)
+			})
+		}
+	}
+}
+
+func testFilterPanic(t *testing.T, inline bool, mode string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:      true,
+		InlineDelivery: inline,
+	})
+	runErr := make(chan error, 1)
+	go func() { runErr <- em.Run(ctx) }()
+
+	add := func(did string) {
+		t.Helper()
+		if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+			RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: did, Handle: "test.example.com"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	boom := func(e *XRPCStreamEvent) {
+		if e.RepoHandle != nil && e.RepoHandle.Did == "did:plc:boom" {
+			panic("boom")
+		}
+	}
+
+	var filter func(*XRPCStreamEvent) bool
+	opts := &SubscribeOpts{}
+	var since *int64
+	switch mode {
+	case "filter":
+		filter = func(e *XRPCStreamEvent) bool { boom(e); return true }
+	case "transform":
+		opts.Transform = func(e *XRPCStreamEvent) *XRPCStreamEvent { boom(e); return e }
+	case "playback":
+		// the panic happens while the subscriber catches up, off the run loop
+		filter = func(e *XRPCStreamEvent) bool { boom(e); return true }
+		add("did:plc:ok")
+		add("did:plc:boom")
+		zero := int64(0)
+		since = &zero
+	}
+
+	good, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := em.SubscribeHandle(ctx, filter, since, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add("did:plc:ok")
+	add("did:plc:boom")
+	add("did:plc:ok")
+
+	// the faulty subscriber is cut off
+	for {
+		select {
+		case _, ok := <-bad.Events():
+			if ok {
+				continue
+			}
+		case <-ctx.Done():
+			t.Fatal("subscriber whose filter panicked was never evicted")
+		}
+		break
+	}
+	if err := bad.Err(); !errors.Is(err, ErrFilterPanicked("")) {
+		t.Fatalf("expected the subscription to end with FilterPanicked, got %v", err)
+	}
+	if n := testutil.ToFloat64(em.metrics.filterPanics); n != 1 {
+		t.Fatalf("expected one filter panic counted, got %v", n)
+	}
+
+	// the run loop carries on, and other subscribers with it
+	add("did:plc:after")
+	late, err := em.SubscribeHandle(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add("did:plc:last")
+
+	var dids []string
+	for len(dids) < 5 {
+		select {
+		case e := <-good.Events():
+			dids = append(dids, e.RepoHandle.Did)
+		case <-ctx.Done():
+			t.Fatalf("healthy subscriber stopped receiving events after %v", dids)
+		}
+	}
+	if got := fmt.Sprint(dids); got != "[did:plc:ok did:plc:boom did:plc:ok did:plc:after did:plc:last]" {
+		t.Fatalf("healthy subscriber got %s", got)
+	}
+
+	select {
+	case e := <-late.Events():
+		if e.RepoHandle.Did != "did:plc:last" {
+			t.Fatalf("new subscriber got %s", e.RepoHandle.Did)
+		}
+	case <-ctx.Done():
+		t.Fatal("subscriber added after the panic got nothing")
+	}
+
+	select {
+	case err := <-runErr:
+		t.Fatalf("run loop exited: %v", err)
+	default:
+	}
+}
@@ -3,65 +3,386 @@ package events
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	label "github.com/bluesky-social/indigo/api/label"
 	"github.com/bluesky-social/indigo/util"
 )
 
 // Note that this interface looks generic, but some persisters might only work with RepoAppend or LabelLabels
 type EventPersistence interface {
-	Persist(ctx context.Context, e *XRPCStreamEvent) error
+	// Persist stores e and returns its seq. Persisters that number events
+	// themselves (say with an auto-increment column) stamp the seq they
+	// assign into e before storing it and return it; those that don't
+	// return the seq e already has. Once stored, e may be read by a
+	// concurrent Playback, so neither the persister nor the manager may
+	// modify it afterwards.
+	Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error)
+
+	// PersistBatch persists events in order, as if by calling Persist on
+	// each. Persisters that can't do better use persistEach.
+	PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error
+
+	// BeginBatch starts a batch of events that are persisted all or
+	// nothing. Persisters without transactions use nonTxBatch.
+	BeginBatch(ctx context.Context) (BatchTx, error)
+
+	// Playback calls cb in increasing seq order with every retained event
+	// whose seq is greater than since. The retained seqs needn't be
+	// contiguous, since events may have been pruned, compacted away or
+	// never written, and since needn't be the seq of an existing event: a
+	// cursor in a hole, before the oldest retained event or negative
+	// resumes with the next event there is, and one at or past the latest
+	// seq plays back nothing and returns nil. The exception is a persister
+	// that knows it has evicted events after since, which may return
+	// ErrCursorEvicted so the gap can be reported; subscribers are then sent
+	// an InfoOutdatedCursor frame and played back from the oldest event.
 	Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error
+
+	// PlaybackByDID is Playback restricted to repo events about a single
+	// account, treating since the same way. Persisters that can't index by
+	// DID use playbackByDIDScan.
+	PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error
+
+	// PlaybackByTime calls cb in seq order with the events whose time falls
+	// in [from, to); a zero from or to leaves that end of the range open.
+	// The time is the time field of repo events, or the latest label cts in
+	// a label batch. Events with a missing or unparseable time are never
+	// played back this way. Persisters that can't index by time use
+	// playbackByTimeScan.
+	PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error
 	TakeDownRepo(ctx context.Context, usr util.Uid) error
+
+	// EarliestSeq returns the seq of the oldest event still available for
+	// playback, and LatestSeq that of the most recently persisted event.
+	// Both return zero if nothing is retained.
+	EarliestSeq(ctx context.Context) (int64, error)
+	LatestSeq(ctx context.Context) (int64, error)
+}
+
+// LabelSnapshotter is implemented by persisters that can summarize the label
+// history as the current set of labels, for subscribers using
+// SubscribeOpts.Snapshot.
+type LabelSnapshotter interface {
+	// Snapshot calls cb with synthetic label batches holding the most recent
+	// label for each (src, uri, val), leaving out those whose most recent
+	// label is a negation, and returns the seq of the last event the
+	// snapshot reflects. Every batch carries that seq. If cb returns an
+	// error, Snapshot stops and returns it.
+	Snapshot(ctx context.Context, cb func(*XRPCStreamEvent) error) (int64, error)
+}
+
+// Pruner is implemented by persisters that can delete old events, for the
+// event manager's pruning loop (see EventManagerOpts.PruneInterval).
+type Pruner interface {
+	// Prune deletes events with seqs below beforeSeq and returns how many
+	// were deleted.
+	Prune(ctx context.Context, beforeSeq int64) (int64, error)
+}
+
+// snapshotBatchSize caps the number of labels in each snapshot batch
+const snapshotBatchSize = 1000
+
+// labelKey identifies the labels that supersede one another
+type labelKey struct {
+	src, uri, val string
+}
+
+// labelState folds label batches into the current label for each key,
+// remembering the order in which they were last set.
+type labelState struct {
+	idx    map[labelKey]int
+	labels []*label.Label
+}
+
+func newLabelState() *labelState {
+	return &labelState{idx: make(map[labelKey]int)}
+}
+
+func (ls *labelState) apply(l *label.Label) {
+	k := labelKey{l.Src, l.Uri, l.Val}
+	if i, ok := ls.idx[k]; ok {
+		ls.labels[i] = nil
+		delete(ls.idx, k)
+	}
+
+	if l.Neg {
+		return
+	}
+
+	ls.idx[k] = len(ls.labels)
+	ls.labels = append(ls.labels, l)
+}
+
+// emit sends the current labels to cb in batches stamped with seq.
+func (ls *labelState) emit(seq int64, cb func(*XRPCStreamEvent) error) error {
+	var batch []*label.Label
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := cb(&XRPCStreamEvent{
+			LabelLabels: &label.SubscribeLabels_Labels{
+				Seq:    seq,
+				Labels: batch,
+			},
+		})
+		batch = nil
+		return err
+	}
+
+	for _, l := range ls.labels {
+		if l == nil {
+			continue
+		}
+
+		batch = append(batch, l)
+		if len(batch) == snapshotBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// BatchTx is a batch of events being persisted as a unit. Events passed to
+// Persist must not become visible to Playback until Commit, and are discarded
+// by Rollback. Exactly one of Commit or Rollback must be called.
+type BatchTx interface {
+	Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
 }
 
+// ErrRollbackUnsupported is returned by the Rollback of a batch from a
+// persister without transactions. Events persisted before the rollback
+// remain persisted.
+var ErrRollbackUnsupported = fmt.Errorf("persister does not support rolling back batches")
+
+// nonTxBatch is the fallback BatchTx, persisting each event immediately.
+type nonTxBatch struct {
+	p EventPersistence
+}
+
+func (b *nonTxBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	return b.p.Persist(ctx, e)
+}
+
+func (b *nonTxBatch) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (b *nonTxBatch) Rollback(ctx context.Context) error {
+	return ErrRollbackUnsupported
+}
+
+// persistEach is the fallback PersistBatch, persisting events one at a time and
+// stopping at the first failure.
+func persistEach(ctx context.Context, p EventPersistence, es []*XRPCStreamEvent) error {
+	for _, e := range es {
+		if _, err := p.Persist(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// playbackByDIDScan is the fallback PlaybackByDID, playing back everything and
+// skipping events for other accounts.
+func playbackByDIDScan(ctx context.Context, p EventPersistence, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if e.repoDID() != did {
+			return nil
+		}
+
+		return cb(e)
+	})
+}
+
+// inTimeRange reports whether e has a time in [from, to), treating a zero
+// bound as open.
+func inTimeRange(e *XRPCStreamEvent, from, to time.Time) bool {
+	t, ok := e.eventTime()
+	if !ok {
+		return false
+	}
+
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// playbackByTimeScan is the fallback PlaybackByTime, playing back everything
+// still retained and skipping events outside the range. Event times aren't
+// guaranteed to rise with seq, so it can't stop early.
+func playbackByTimeScan(ctx context.Context, p EventPersistence, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	earliest, err := p.EarliestSeq(ctx)
+	if err != nil {
+		return err
+	}
+
+	var since int64
+	if earliest > 0 {
+		since = earliest - 1
+	}
+
+	return p.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if !inTimeRange(e, from, to) {
+			return nil
+		}
+
+		return cb(e)
+	})
+}
+
+// ErrCursorEvicted is returned by Playback when events after the requested
+// cursor are no longer retained.
+var ErrCursorEvicted = fmt.Errorf("requested cursor is older than the oldest retained event")
+
 // MemPersister is the most naive implementation of event persistence
 // This EventPersistence option works fine with all event types
-// ill do better later
+// By default it keeps every event; with a capacity it keeps only the most
+// recent events in a ring buffer.
 type MemPersister struct {
-	buf []*XRPCStreamEvent
 	lk  sync.Mutex
 	seq int64
+
+	// buf is used as a ring when capacity is non-zero, with start pointing
+	// at the oldest element
+	buf      []*XRPCStreamEvent
+	start    int
+	capacity int
+	evicted  bool
 }
 
 func NewMemPersister() *MemPersister {
 	return &MemPersister{}
 }
 
-func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+// NewRingMemPersister returns a MemPersister that retains at most capacity
+// events, evicting the oldest once full.
+func NewRingMemPersister(capacity int) *MemPersister {
+	return &MemPersister{
+		buf:      make([]*XRPCStreamEvent, 0, capacity),
+		capacity: capacity,
+	}
+}
+
+func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
 	mp.lk.Lock()
 	defer mp.lk.Unlock()
-	mp.seq++
-	switch {
-	case e.RepoCommit != nil:
-		e.RepoCommit.Seq = mp.seq
-	case e.RepoHandle != nil:
-		e.RepoHandle.Seq = mp.seq
-	case e.RepoMigrate != nil:
-		e.RepoMigrate.Seq = mp.seq
-	case e.RepoTombstone != nil:
-		e.RepoTombstone.Seq = mp.seq
-	case e.LabelLabels != nil:
-		e.LabelLabels.Seq = mp.seq
-	default:
+
+	mp.seq = memNextSeq(mp.seq, e)
+	mp.append(e)
+
+	return mp.seq, nil
+}
+
+// memNextSeq returns the seq e is stored under, given the last seq stored.
+func memNextSeq(last int64, e *XRPCStreamEvent) int64 {
+	if !e.hasSequence() {
 		panic("no event in persist call")
 	}
+
+	// respect seqs assigned by the event manager, otherwise number events
+	// ourselves
+	if seq := e.sequence(); seq > last {
+		return seq
+	}
+
+	e.setSequence(last + 1)
+	return last + 1
+}
+
+// append stores e, evicting the oldest event if the ring is full. The caller
+// must hold lk.
+func (mp *MemPersister) append(e *XRPCStreamEvent) {
+	if mp.capacity > 0 && len(mp.buf) == mp.capacity {
+		mp.buf[mp.start] = e
+		mp.start = (mp.start + 1) % mp.capacity
+		mp.evicted = true
+		return
+	}
+
 	mp.buf = append(mp.buf, e)
+}
+
+func (mp *MemPersister) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	return persistEach(ctx, mp, es)
+}
+
+// BeginBatch holds the persister's lock until the batch is committed or
+// rolled back, so the batch's seqs can't be taken by anything else.
+func (mp *MemPersister) BeginBatch(ctx context.Context) (BatchTx, error) {
+	mp.lk.Lock()
+	return &memBatch{mp: mp, seq: mp.seq}, nil
+}
+
+type memBatch struct {
+	mp      *MemPersister
+	seq     int64
+	pending []*XRPCStreamEvent
+}
+
+func (b *memBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	// unlike Persist, fail rather than panic so the batch can roll back
+	if !e.hasSequence() {
+		return 0, fmt.Errorf("cannot persist %s event", e.kind())
+	}
+
+	b.seq = memNextSeq(b.seq, e)
+	b.pending = append(b.pending, e)
+	return b.seq, nil
+}
+
+func (b *memBatch) Commit(ctx context.Context) error {
+	defer b.mp.lk.Unlock()
+
+	for _, e := range b.pending {
+		b.mp.append(e)
+	}
+	b.mp.seq = b.seq
 
 	return nil
 }
 
-func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+func (b *memBatch) Rollback(ctx context.Context) error {
+	b.mp.lk.Unlock()
+	return nil
+}
+
+// snapshot returns the retained events in seq order, and whether any events
+// have been evicted.
+func (mp *MemPersister) snapshot() ([]*XRPCStreamEvent, bool) {
 	mp.lk.Lock()
-	l := len(mp.buf)
-	mp.lk.Unlock()
+	defer mp.lk.Unlock()
 
-	if since >= int64(l) {
-		return nil
+	// an unbounded buffer is only ever appended to, so it is safe to share
+	if mp.capacity == 0 {
+		return mp.buf[:len(mp.buf):len(mp.buf)], mp.evicted
 	}
 
-	// TODO: abusing the fact that buf[0].seq is currently always 1
-	for _, e := range mp.buf[since:l] {
+	out := make([]*XRPCStreamEvent, 0, len(mp.buf))
+	out = append(out, mp.buf[mp.start:]...)
+	out = append(out, mp.buf[:mp.start]...)
+	return out, mp.evicted
+}
+
+func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	buf, evicted := mp.snapshot()
+	if evicted && len(buf) > 0 && since < buf[0].sequence()-1 {
+		return ErrCursorEvicted
+	}
+
+	for _, e := range buf {
+		if e.sequence() <= since {
+			continue
+		}
+
 		if err := cb(e); err != nil {
 			return err
 		}
@@ -70,6 +391,80 @@ func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+// Prune drops retained events with seqs below beforeSeq. Playback from a
+// cursor before the remaining events then returns ErrCursorEvicted.
+func (mp *MemPersister) Prune(ctx context.Context, beforeSeq int64) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	ordered := append(mp.buf[mp.start:len(mp.buf):len(mp.buf)], mp.buf[:mp.start]...)
+	n := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].sequence() >= beforeSeq
+	})
+	if n == 0 {
+		return 0, nil
+	}
+
+	if mp.capacity == 0 {
+		// playbacks may still be reading the old slice, which stays valid
+		mp.buf = mp.buf[n:]
+	} else {
+		mp.buf = append(make([]*XRPCStreamEvent, 0, mp.capacity), ordered[n:]...)
+		mp.start = 0
+	}
+	mp.evicted = true
+
+	return int64(n), nil
+}
+
+// Snapshot folds every retained label batch into the current label state. Once
+// events have been evicted or pruned the full history is no longer known, so
+// it returns ErrCursorEvicted instead.
+func (mp *MemPersister) Snapshot(ctx context.Context, cb func(*XRPCStreamEvent) error) (int64, error) {
+	buf, evicted := mp.snapshot()
+	if evicted {
+		return 0, ErrCursorEvicted
+	}
+
+	var seq int64
+	state := newLabelState()
+	for _, e := range buf {
+		seq = e.sequence()
+		if e.LabelLabels == nil {
+			continue
+		}
+
+		for _, l := range e.LabelLabels.Labels {
+			state.apply(l)
+		}
+	}
+
+	return seq, state.emit(seq, cb)
+}
+
+func (mp *MemPersister) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return playbackByDIDScan(ctx, mp, did, since, cb)
+}
+
+func (mp *MemPersister) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return playbackByTimeScan(ctx, mp, from, to, cb)
+}
+
+func (mp *MemPersister) LatestSeq(ctx context.Context) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+	return mp.seq, nil
+}
+
+func (mp *MemPersister) EarliestSeq(ctx context.Context) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+	if len(mp.buf) == 0 {
+		return 0, nil
+	}
+	return mp.buf[mp.start].sequence(), nil
+}
+
 func (mp *MemPersister) TakeDownRepo(ctx context.Context, uid util.Uid) error {
 	return fmt.Errorf("repo takedowns not currently supported by memory persister, test usage only")
 }
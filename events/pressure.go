@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Pressure returns how backed up fan-out is, as the fullest live
+// subscriber's buffer utilization, from 0 with no subscribers or all of them
+// keeping up to 1 once one of them is dropping events. It is sampled every
+// UtilizationSampleInterval, so producers can cheaply poll it to slow their
+// own ingestion when subscribers can't keep up; see also ThrottleAbove.
+// Subscribers still catching up from a cursor aren't counted, since their
+// playback fills their buffers as fast as they drain regardless of ingestion,
+// and nor are Tail subscribers.
+func (em *EventManager) Pressure() float64 {
+	return math.Float64frombits(em.pressure.Load())
+}
+
+// samplePressure records the current pressure. It must be called from the
+// run loop.
+func (em *EventManager) samplePressure() {
+	var p float64
+	for _, s := range em.subs {
+		if !s.live.Load() || s.tail {
+			continue
+		}
+		if u := s.bufferUtilization(); u > p {
+			p = u
+		}
+	}
+
+	em.pressure.Store(math.Float64bits(p))
+	em.metrics.pressure.Set(p)
+}
+
+// throttle delays a producer in proportion to how far Pressure is above
+// ThrottleAbove, up to MaxThrottleDelay once it reaches 1.
+func (em *EventManager) throttle(ctx context.Context) error {
+	if em.throttleAbove <= 0 {
+		return nil
+	}
+
+	p := em.Pressure()
+	if p <= em.throttleAbove {
+		return nil
+	}
+
+	d := time.Duration(float64(em.maxThrottleDelay) * (p - em.throttleAbove) / (1 - em.throttleAbove))
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-em.closed:
+		return fmt.Errorf("event manager shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,155 @@
+package events
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Priority is the class an event is submitted in. The run loop keeps a
+// separate queue per class and takes from the highest class with anything
+// waiting, so a bulk producer such as a backfill crawler can share a manager
+// with a latency-sensitive live one without holding it up.
+//
+// The guarantees are:
+//
+//   - Within a class, operations are taken in the order they were submitted.
+//   - Across classes they may be reordered, even from a single producer, so
+//     a producer that relies on its events going out in seq order must keep
+//     them in one class. With AssignSeq, seqs follow the order events are
+//     taken, so they still increase.
+//   - An operation waits behind at most a few others of lower classes: one
+//     in progress, the occasional turn given below, and the random pick
+//     between queues the run loop makes after every priorityBurst
+//     operations (see EventManager). So the latency of a high priority
+//     event does not grow with the backlog beneath it.
+//   - Lower classes are slowed by a flood above them but never stalled: one
+//     in every priorityBurst operations comes from a lower class with
+//     anything waiting, taking turns between them.
+//
+// Subscriptions, queries and other control operations aren't in any class:
+// they have a queue of their own, taken from ahead of all of them. Each queue
+// is buffered by OpsBufferSize separately.
+type Priority int
+
+const (
+	// PriorityNormal is the class of events submitted with AddEvent and
+	// AddEvents, other than info and error frames.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh is for events that shouldn't wait behind others, and
+	// the default for info and error frames, which tell consumers about
+	// the state of the stream.
+	PriorityHigh
+
+	// PriorityLow is for bulk producers that can tolerate waiting, such as
+	// backfills.
+	PriorityLow
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
+// priorityBurst is how often the run loop gives lower classes a turn ahead
+// of higher ones, in operations taken.
+const priorityBurst = 16
+
+// defaultPriority is the class events are submitted in when the producer
+// doesn't choose one: high if they are all info or error frames, otherwise
+// normal.
+func defaultPriority(evs ...*XRPCStreamEvent) Priority {
+	for _, ev := range evs {
+		if ev.hasSequence() {
+			return PriorityNormal
+		}
+	}
+
+	return PriorityHigh
+}
+
+// opsFor returns the queue for operations of class pri.
+func (em *EventManager) opsFor(pri Priority) chan *Operation {
+	switch pri {
+	case PriorityHigh:
+		return em.highOps
+	case PriorityLow:
+		return em.lowOps
+	default:
+		return em.ops
+	}
+}
+
+// queueFor returns the queue for op: its class's if it is an event, and the
+// control queue otherwise.
+func (em *EventManager) queueFor(op *Operation) chan *Operation {
+	if op.op == opSend || op.op == opSendBatch {
+		return em.opsFor(op.pri)
+	}
+	return em.ctrlOps
+}
+
+// opsQueued is the number of operations waiting in all of the queues.
+func (em *EventManager) opsQueued() int {
+	return len(em.ctrlOps) + len(em.highOps) + len(em.ops) + len(em.lowOps)
+}
+
+// nextOp takes a waiting operation without blocking, or returns nil if there
+// is none. Control operations come first, then events from the highest class
+// with one waiting, except that every priorityBurst-th event starts from one
+// of the lower classes in turn. Only the run loop calls it.
+func (em *EventManager) nextOp() *Operation {
+	select {
+	case op := <-em.ctrlOps:
+		return op
+	default:
+	}
+
+	classes := [...]chan *Operation{em.highOps, em.ops, em.lowOps}
+
+	em.opTurn++
+	start := 0
+	if em.opTurn%priorityBurst == 0 {
+		start = 1 + int(em.opTurn/priorityBurst)%(len(classes)-1)
+	}
+
+	for i := range classes {
+		select {
+		case op := <-classes[(start+i)%len(classes)]:
+			return op
+		default:
+		}
+	}
+
+	return nil
+}
+
+// AddEventWithPriority is like AddEvent, but submits ev in class pri rather
+// than the default.
+func (em *EventManager) AddEventWithPriority(ctx context.Context, ev *XRPCStreamEvent, pri Priority) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEventWithPriority")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("priority", pri.String()))
+	return em.addEvent(ctx, ev, pri, em.failOnPersistError)
+}
+
+// AddEventsWithPriority is like AddEvents, but submits the batch in class
+// pri rather than the default.
+func (em *EventManager) AddEventsWithPriority(ctx context.Context, evs []*XRPCStreamEvent, pri Priority) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEventsWithPriority")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("priority", pri.String()))
+	return em.addEvents(ctx, evs, pri)
+}
@@ -0,0 +1,72 @@
+package events
+
+import (
+	"context"
+	"time"
+)
+
+// pruneLoop prunes old events every prune interval until the manager shuts
+// down.
+func (em *EventManager) pruneLoop(ctx context.Context) {
+	pruner, ok := em.persister.(Pruner)
+	if !ok {
+		em.log.Errorw("pruning is enabled but the persister can't prune", "persister", em.persister)
+		return
+	}
+
+	t := time.NewTicker(em.pruneInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := em.prune(ctx, pruner); err != nil {
+				em.log.Errorw("failed to prune events", "err", err)
+			}
+		case <-em.closed:
+			return
+		}
+	}
+}
+
+// prune deletes events older than the retention window, but none that a
+// subscriber still catching up has yet to play back.
+func (em *EventManager) prune(ctx context.Context, pruner Pruner) error {
+	latest, err := em.persister.LatestSeq(ctx)
+	if err != nil {
+		return err
+	}
+
+	floor := latest - em.retainSeqs + 1
+	if err := em.query(ctx, func() {
+		for _, s := range em.subs {
+			if s.live.Load() {
+				continue
+			}
+
+			// the subscriber still needs everything after its cursor
+			if c := s.cursor.Load() + 1; c < floor {
+				floor = c
+			}
+		}
+	}); err != nil {
+		return err
+	}
+
+	if floor <= 1 {
+		return nil
+	}
+
+	n, err := pruner.Prune(ctx, floor)
+	if err != nil {
+		return err
+	}
+
+	em.metrics.pruned.Add(float64(n))
+	em.metrics.retentionFloor.Set(float64(floor))
+	if n > 0 {
+		em.log.Infow("pruned events", "count", n, "floor", floor)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package events
+
+import (
+	"context"
+	"time"
+)
+
+// ReplayMode selects how Replay paces the events it plays back.
+type ReplayMode int
+
+const (
+	// ReplayAsFast delivers events as fast as the callback takes them.
+	ReplayAsFast ReplayMode = iota
+
+	// ReplayRealtime spaces events out by the difference between their
+	// times, reproducing the rate at which they were recorded.
+	ReplayRealtime
+
+	// ReplayFixedInterval delivers one event every ReplayOpts.Interval.
+	ReplayFixedInterval
+)
+
+// ReplayOpts controls the pacing of Replay.
+type ReplayOpts struct {
+	Mode ReplayMode
+
+	// Speed scales the gaps in ReplayRealtime, so 2 replays twice as fast as
+	// recorded. Zero means 1.
+	Speed float64
+
+	// MaxDelay caps any single gap in ReplayRealtime, so a long quiet
+	// stretch in the recording doesn't stall a test. Zero means no cap.
+	MaxDelay time.Duration
+
+	// Interval is the spacing between events in ReplayFixedInterval.
+	Interval time.Duration
+}
+
+// Replay plays back the events in p with seqs after since, pacing calls to cb
+// according to opts, for testing consumers against recorded events. Pacing is
+// measured from when Replay starts rather than from the previous event, so a
+// slow callback doesn't make the replay drift behind.
+//
+// In ReplayRealtime an event's time is taken from its time field, or the
+// latest label cts for label batches. Events with no usable time, or a time
+// before that of an earlier event, are delivered straight after the event
+// before them.
+func Replay(ctx context.Context, p EventPersistence, since int64, opts *ReplayOpts, cb func(*XRPCStreamEvent) error) error {
+	if opts == nil {
+		opts = &ReplayOpts{}
+	}
+
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	start := time.Now()
+	var (
+		n       int
+		offset  time.Duration
+		prev    time.Time
+		hasPrev bool
+	)
+
+	return p.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		switch opts.Mode {
+		case ReplayRealtime:
+			if t, ok := e.eventTime(); ok {
+				if hasPrev && t.After(prev) {
+					gap := time.Duration(float64(t.Sub(prev)) / speed)
+					if opts.MaxDelay > 0 && gap > opts.MaxDelay {
+						gap = opts.MaxDelay
+					}
+					offset += gap
+				}
+				if !hasPrev || t.After(prev) {
+					prev, hasPrev = t, true
+				}
+			}
+		case ReplayFixedInterval:
+			offset = time.Duration(n) * opts.Interval
+		}
+		n++
+
+		if err := sleepUntil(ctx, start.Add(offset)); err != nil {
+			return err
+		}
+
+		return cb(e)
+	})
+}
+
+// sleepUntil waits until t or until ctx is done, whichever comes first.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,253 @@
+package events
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// router indexes subscribers by the accounts and PDS ids they asked for with
+// SubscribeOpts.Uids and SubscribeOpts.Pds, so broadcast can skip subscribers
+// that an event isn't meant for without calling their filters. A subscriber
+// restricted both ways is indexed by account only. The index only narrows
+// down who is offered an event; the restrictions are enforced by
+// Subscriber.accepts. It is owned by the run loop.
+type router struct {
+	// unrestricted holds the subscribers that take events for any account
+	// or PDS
+	unrestricted []*Subscriber
+	byUid        map[util.Uid][]*Subscriber
+	byPds        map[uint][]*Subscriber
+
+	// gen marks the subscribers already picked for the current event, and
+	// buf is reused to collect them
+	gen uint64
+	buf []*Subscriber
+}
+
+// eventPds calls fn with each PDS id evt is routed to, returning false if it
+// carries no routing information.
+func eventPds(evt *XRPCStreamEvent, fn func(uint)) bool {
+	if evt.PrivPdsId == 0 && len(evt.PrivRelevantPds) == 0 {
+		return false
+	}
+
+	if evt.PrivPdsId != 0 {
+		fn(evt.PrivPdsId)
+	}
+	for _, id := range evt.PrivRelevantPds {
+		fn(id)
+	}
+
+	return true
+}
+
+// routedTo reports whether a subscriber restricted to pds should receive
+// evt. Events without routing information go to everyone.
+func routedTo(pds []uint, evt *XRPCStreamEvent) bool {
+	match := false
+	routed := eventPds(evt, func(id uint) {
+		for _, p := range pds {
+			if p == id {
+				match = true
+			}
+		}
+	})
+
+	return !routed || match
+}
+
+// forUids reports whether a subscriber restricted to uids should receive
+// evt: repo events attributed to one of the accounts, and info and error
+// frames, which are about the stream itself. Label batches and repo events
+// without a PrivUid can't be attributed, so they are not delivered.
+func forUids(uids map[util.Uid]struct{}, evt *XRPCStreamEvent) bool {
+	if evt.Error != nil || evt.RepoInfo != nil || evt.LabelInfo != nil {
+		return true
+	}
+
+	if evt.PrivUid == 0 {
+		return false
+	}
+
+	_, ok := uids[evt.PrivUid]
+	return ok
+}
+
+func (r *router) add(s *Subscriber) {
+	switch {
+	case len(s.uids) > 0:
+		if r.byUid == nil {
+			r.byUid = make(map[util.Uid][]*Subscriber)
+		}
+		for uid := range s.uids {
+			r.byUid[uid] = append(r.byUid[uid], s)
+		}
+	case len(s.pds) > 0:
+		if r.byPds == nil {
+			r.byPds = make(map[uint][]*Subscriber)
+		}
+		for _, id := range s.pds {
+			r.byPds[id] = append(r.byPds[id], s)
+		}
+	default:
+		r.unrestricted = append(r.unrestricted, s)
+	}
+}
+
+func (r *router) remove(s *Subscriber) {
+	switch {
+	case len(s.uids) > 0:
+		for uid := range s.uids {
+			if subs := removeSubscriber(r.byUid[uid], s); len(subs) > 0 {
+				r.byUid[uid] = subs
+			} else {
+				delete(r.byUid, uid)
+			}
+		}
+	case len(s.pds) > 0:
+		for _, id := range s.pds {
+			if subs := removeSubscriber(r.byPds[id], s); len(subs) > 0 {
+				r.byPds[id] = subs
+			} else {
+				delete(r.byPds, id)
+			}
+		}
+	default:
+		r.unrestricted = removeSubscriber(r.unrestricted, s)
+	}
+}
+
+// targets returns the subscribers evt should be offered to. Events that some
+// restricted subscribers take regardless of their restriction, those without
+// PDS routing information or without a PrivUid, are offered to everyone. The
+// result is only valid until the next call.
+func (r *router) targets(evt *XRPCStreamEvent, all []*Subscriber) []*Subscriber {
+	if len(r.byPds) == 0 && len(r.byUid) == 0 {
+		return all
+	}
+
+	if len(r.byUid) > 0 && evt.PrivUid == 0 {
+		return all
+	}
+
+	if len(r.byPds) > 0 && evt.PrivPdsId == 0 && len(evt.PrivRelevantPds) == 0 {
+		return all
+	}
+
+	r.gen++
+	r.buf = append(r.buf[:0], r.unrestricted...)
+	pick := func(subs []*Subscriber) {
+		for _, s := range subs {
+			if s.routeGen != r.gen {
+				s.routeGen = r.gen
+				r.buf = append(r.buf, s)
+			}
+		}
+	}
+
+	pick(r.byUid[evt.PrivUid])
+	eventPds(evt, func(id uint) {
+		pick(r.byPds[id])
+	})
+
+	return r.buf
+}
+
+// removeSubscriber removes s from subs without preserving order.
+func removeSubscriber(subs []*Subscriber, s *Subscriber) []*Subscriber {
+	for i, o := range subs {
+		if o == s {
+			subs[i] = subs[len(subs)-1]
+			subs[len(subs)-1] = nil
+			return subs[:len(subs)-1]
+		}
+	}
+
+	return subs
+}
+
+// Persisters with a PersistRouting option store an event's private routing
+// fields alongside it, outside the wire format, so that replayed events reach
+// subscribers restricted by Uids or Pds just as live ones do. These helpers
+// encode them.
+
+// encodeRelevantPds serializes PrivRelevantPds for a database column, as nil
+// if there are none.
+func encodeRelevantPds(ids []uint) ([]byte, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(ids)
+}
+
+func decodeRelevantPds(b []byte) ([]uint, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	var ids []uint
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, fmt.Errorf("decoding relevant pds: %w", err)
+	}
+
+	return ids, nil
+}
+
+// appendRouting appends evt's routing fields to b as uvarints: the uid, the
+// pds id, and the relevant pds ids preceded by their count.
+func appendRouting(b []byte, evt *XRPCStreamEvent) []byte {
+	b = binary.AppendUvarint(b, uint64(evt.PrivUid))
+	b = binary.AppendUvarint(b, uint64(evt.PrivPdsId))
+	b = binary.AppendUvarint(b, uint64(len(evt.PrivRelevantPds)))
+	for _, id := range evt.PrivRelevantPds {
+		b = binary.AppendUvarint(b, uint64(id))
+	}
+
+	return b
+}
+
+// readRouting restores routing fields written by appendRouting into evt.
+func readRouting(b []byte, evt *XRPCStreamEvent) error {
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed routing fields")
+		}
+		b = b[n:]
+		return v, nil
+	}
+
+	uid, err := next()
+	if err != nil {
+		return err
+	}
+	pds, err := next()
+	if err != nil {
+		return err
+	}
+	count, err := next()
+	if err != nil {
+		return err
+	}
+	if count > uint64(len(b)) {
+		return fmt.Errorf("malformed routing fields")
+	}
+
+	var relevant []uint
+	for i := uint64(0); i < count; i++ {
+		id, err := next()
+		if err != nil {
+			return err
+		}
+		relevant = append(relevant, uint(id))
+	}
+
+	evt.PrivUid = util.Uid(uid)
+	evt.PrivPdsId = uint(pds)
+	evt.PrivRelevantPds = relevant
+	return nil
+}
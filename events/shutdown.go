@@ -0,0 +1,112 @@
+package events
+
+import (
+	"context"
+	"time"
+)
+
+// ShutdownMode chooses what happens to events already handed to subscribers
+// but not yet taken by their consumers when the manager shuts down.
+type ShutdownMode int
+
+const (
+	// ShutdownDrop closes subscriber channels as soon as the manager shuts
+	// down, discarding whatever is still buffered for them.
+	ShutdownDrop ShutdownMode = iota
+
+	// ShutdownDrain lets each subscriber's consumer take everything
+	// buffered for it before its channel is closed. Shutdown waits for
+	// every consumer to do so, or for its context to be done, at which
+	// point whatever is left is discarded as with ShutdownDrop.
+	ShutdownDrain
+)
+
+// drainPollInterval is how often Shutdown checks whether consumers have
+// emptied their buffers
+const drainPollInterval = 5 * time.Millisecond
+
+// stop closes the manager to new operations and, in ShutdownDrop mode,
+// abandons buffered events along with it.
+func (em *EventManager) stop() {
+	em.closeOnce.Do(func() {
+		close(em.closed)
+	})
+
+	if em.shutdownMode == ShutdownDrop {
+		em.abandon()
+	}
+}
+
+// abandon stops delivery goroutines and playback from handing over any more
+// events, and makes finish discard what is still buffered.
+func (em *EventManager) abandon() {
+	em.dropOnce.Do(func() {
+		close(em.dropping)
+	})
+}
+
+// discard empties the subscriber's outgoing channel, counting what it throws
+// away as dropped. It is safe whether or not outgoing has been closed.
+func (em *EventManager) discard(s *Subscriber) {
+	for {
+		select {
+		case evt, ok := <-s.outgoing:
+			if !ok {
+				return
+			}
+			em.metrics.dropped.WithLabelValues(evt.kind()).Inc()
+			s.dropped.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// flush waits for every subscriber closed by the run loop to be finished
+// and, in ShutdownDrain mode, for its consumer to take what was left in its
+// buffer. If ctx is done first, the rest is discarded once the subscriber's
+// writer has stopped, which abandoning makes prompt, so nothing more reaches
+// the consumer after flush returns. It must only be called once the run loop
+// has exited.
+func (em *EventManager) flush(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+
+	for !em.flushed() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			em.abandon()
+			for _, s := range em.closing {
+				<-s.finished
+				em.discard(s)
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (em *EventManager) flushed() bool {
+	for _, s := range em.closing {
+		select {
+		case <-s.finished:
+		default:
+			return false
+		}
+
+		// nobody is left to take the events of consumers that went away
+		select {
+		case <-s.done:
+			continue
+		default:
+		}
+
+		if em.shutdownMode == ShutdownDrain && len(s.outgoing) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
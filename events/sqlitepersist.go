@@ -0,0 +1,415 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SQLitePersistence stores serialized events in a local SQLite database,
+// keyed by seq. It works with all event types and is intended for
+// single-node deployments that want durable playback without running a
+// separate database server.
+type SQLitePersistence struct {
+	db *gorm.DB
+
+	// lk serializes seq assignment for events persisted without one
+	lk  sync.Mutex
+	seq int64
+
+	compressBlocks bool
+	persistRouting bool
+}
+
+// SQLiteOpts holds optional SQLitePersistence settings.
+type SQLiteOpts struct {
+	// CompressBlocks stores commit Blocks zstd compressed. Each record says
+	// whether its blocks are compressed, so the setting can be changed on
+	// an existing database, and playback always returns them uncompressed.
+	CompressBlocks bool
+
+	// PersistRouting stores each event's PrivPdsId and PrivRelevantPds with
+	// it and restores them on playback, so replayed events route to
+	// subscribers the same way live ones do. PrivUid is always stored.
+	PersistRouting bool
+}
+
+type SQLiteEventRecord struct {
+	Seq       int64    `gorm:"primarykey;autoIncrement:false"`
+	Uid       util.Uid `gorm:"index"`
+	Did       string   `gorm:"index"`
+	Kind      string
+	Data      []byte
+	CreatedAt time.Time `gorm:"index"`
+
+	// EventTime is the time the event says it happened, in UTC, or nil if it
+	// has none (see EventPersistence.PlaybackByTime)
+	EventTime *time.Time `gorm:"index"`
+
+	// BlocksCompressed is set if the commit's Blocks in Data are zstd
+	// compressed
+	BlocksCompressed bool
+
+	// PdsId and RelevantPds hold the event's routing fields, if the
+	// persister was configured to keep them
+	PdsId       uint
+	RelevantPds []byte
+}
+
+// sqlitePlaybackPage bounds how many rows each playback query reads, so a
+// long playback never holds the database connection for long.
+const sqlitePlaybackPage = 500
+
+func NewSQLitePersistence(path string) (*SQLitePersistence, error) {
+	return NewSQLitePersistenceWithOpts(path, nil)
+}
+
+func NewSQLitePersistenceWithOpts(path string, opts *SQLiteOpts) (*SQLitePersistence, error) {
+	if opts == nil {
+		opts = &SQLiteOpts{}
+	}
+
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		SkipDefaultTransaction: true,
+		PrepareStmt:            true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sqldb, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only supports a single writer, so funnel everything through one
+	// connection rather than fighting over the file lock
+	sqldb.SetMaxOpenConns(1)
+
+	// the pragma returns the new mode as a row, which has to be read or the
+	// cached statement keeps an implicit transaction open forever
+	var mode string
+	if err := db.Raw("PRAGMA journal_mode=WAL").Scan(&mode).Error; err != nil {
+		return nil, fmt.Errorf("enabling WAL: %w", err)
+	}
+
+	if err := db.AutoMigrate(&SQLiteEventRecord{}); err != nil {
+		return nil, err
+	}
+
+	p := &SQLitePersistence{
+		db:             db,
+		compressBlocks: opts.CompressBlocks,
+		persistRouting: opts.PersistRouting,
+	}
+
+	seq, err := p.LatestSeq(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	p.seq = seq
+
+	return p, nil
+}
+
+func (p *SQLitePersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	saved := p.seq
+	unnumbered := unnumberedEvents([]*XRPCStreamEvent{e})
+
+	rec, err := p.record(e)
+	if err != nil {
+		p.unnumber(saved, unnumbered)
+		return 0, err
+	}
+
+	if err := p.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(rec).Error; err != nil {
+		p.unnumber(saved, unnumbered)
+		return 0, err
+	}
+
+	return e.sequence(), nil
+}
+
+// unnumberedEvents returns the events in es that record will assign a seq.
+func unnumberedEvents(es []*XRPCStreamEvent) []*XRPCStreamEvent {
+	var out []*XRPCStreamEvent
+	for _, e := range es {
+		if e.hasSequence() && e.sequence() == 0 {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// unnumber undoes record's seq assignment after a failed write, so the seqs
+// are handed out again and the events don't carry seqs that were never
+// stored. The caller must hold lk.
+func (p *SQLitePersistence) unnumber(saved int64, unnumbered []*XRPCStreamEvent) {
+	p.seq = saved
+	for _, e := range unnumbered {
+		e.setSequence(0)
+	}
+}
+
+// BeginBatch runs the batch in a database transaction, holding lk until it
+// finishes so that a rollback can also undo seq assignment.
+func (p *SQLitePersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	p.lk.Lock()
+
+	tx := p.db.WithContext(ctx).Begin()
+	if err := tx.Error; err != nil {
+		p.lk.Unlock()
+		return nil, err
+	}
+
+	return &sqliteBatch{p: p, tx: tx, savedSeq: p.seq}, nil
+}
+
+type sqliteBatch struct {
+	p  *SQLitePersistence
+	tx *gorm.DB
+
+	// savedSeq is restored, and the seqs of the unnumbered events cleared,
+	// if the batch doesn't commit
+	savedSeq   int64
+	unnumbered []*XRPCStreamEvent
+}
+
+func (b *sqliteBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	b.unnumbered = append(b.unnumbered, unnumberedEvents([]*XRPCStreamEvent{e})...)
+	rec, err := b.p.record(e)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := b.tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(rec).Error; err != nil {
+		return 0, err
+	}
+
+	return e.sequence(), nil
+}
+
+func (b *sqliteBatch) Commit(ctx context.Context) error {
+	defer b.p.lk.Unlock()
+
+	if err := b.tx.Commit().Error; err != nil {
+		b.p.unnumber(b.savedSeq, b.unnumbered)
+		return err
+	}
+
+	return nil
+}
+
+func (b *sqliteBatch) Rollback(ctx context.Context) error {
+	defer b.p.lk.Unlock()
+
+	b.p.unnumber(b.savedSeq, b.unnumbered)
+	return b.tx.Rollback().Error
+}
+
+// sqliteInsertBatch keeps multi-row inserts under sqlite's bound variable
+// limit
+const sqliteInsertBatch = 100
+
+// PersistBatch writes all events in as few INSERT statements as possible.
+func (p *SQLitePersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	saved := p.seq
+	unnumbered := unnumberedEvents(es)
+
+	recs := make([]*SQLiteEventRecord, 0, len(es))
+	for _, e := range es {
+		rec, err := p.record(e)
+		if err != nil {
+			p.unnumber(saved, unnumbered)
+			return err
+		}
+		recs = append(recs, rec)
+	}
+
+	if err := p.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(recs, sqliteInsertBatch).Error; err != nil {
+		p.unnumber(saved, unnumbered)
+		return err
+	}
+
+	return nil
+}
+
+// record assigns e a seq if it doesn't have one and serializes it. The caller
+// must hold lk.
+func (p *SQLitePersistence) record(e *XRPCStreamEvent) (*SQLiteEventRecord, error) {
+	if !e.hasSequence() {
+		return nil, fmt.Errorf("cannot persist %s event", e.kind())
+	}
+
+	// respect seqs assigned by the event manager, otherwise number events
+	// ourselves
+	if seq := e.sequence(); seq > p.seq {
+		p.seq = seq
+	} else if seq == 0 {
+		p.seq++
+		e.setSequence(p.seq)
+	}
+
+	stored := e
+	compressed := p.compressBlocks && e.hasBlocks()
+	if compressed {
+		stored = e.withBlocks(CompressBlocks(e.RepoCommit.Blocks))
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("serializing event: %w", err)
+	}
+
+	var et *time.Time
+	if t, ok := e.eventTime(); ok {
+		t = t.UTC()
+		et = &t
+	}
+
+	rec := &SQLiteEventRecord{
+		Seq:       e.sequence(),
+		Uid:       e.PrivUid,
+		Did:       e.repoDID(),
+		Kind:      e.kind(),
+		Data:      data,
+		CreatedAt: time.Now(),
+		EventTime: et,
+
+		BlocksCompressed: compressed,
+	}
+
+	if p.persistRouting {
+		relevant, err := encodeRelevantPds(e.PrivRelevantPds)
+		if err != nil {
+			return nil, err
+		}
+		rec.PdsId = e.PrivPdsId
+		rec.RelevantPds = relevant
+	}
+
+	return rec, nil
+}
+
+func (p *SQLitePersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.playback(ctx, since, cb, nil)
+}
+
+// PlaybackByDID uses the did index. Events persisted before the did column
+// was added have it empty, so they are not found.
+func (p *SQLitePersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.playback(ctx, since, cb, func(q *gorm.DB) *gorm.DB {
+		return q.Where("did = ?", did)
+	})
+}
+
+// PlaybackByTime uses the event_time index. Events persisted before the
+// column was added have no time, so they are not found.
+func (p *SQLitePersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return p.playback(ctx, 0, cb, func(q *gorm.DB) *gorm.DB {
+		q = q.Where("event_time IS NOT NULL")
+		if !from.IsZero() {
+			q = q.Where("event_time >= ?", from.UTC())
+		}
+		if !to.IsZero() {
+			q = q.Where("event_time < ?", to.UTC())
+		}
+		return q
+	})
+}
+
+// playback pages through events after since, narrowed by scope if it is set.
+func (p *SQLitePersistence) playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error, scope func(*gorm.DB) *gorm.DB) error {
+	for {
+		q := p.db.WithContext(ctx).Where("seq > ?", since)
+		if scope != nil {
+			q = scope(q)
+		}
+
+		var recs []SQLiteEventRecord
+		if err := q.Order("seq asc").Limit(sqlitePlaybackPage).Find(&recs).Error; err != nil {
+			return err
+		}
+
+		for _, rec := range recs {
+			var evt XRPCStreamEvent
+			if err := json.Unmarshal(rec.Data, &evt); err != nil {
+				return fmt.Errorf("decoding event %d: %w", rec.Seq, err)
+			}
+			evt.PrivUid = rec.Uid
+			evt.PrivPdsId = rec.PdsId
+			relevant, err := decodeRelevantPds(rec.RelevantPds)
+			if err != nil {
+				return fmt.Errorf("decoding event %d: %w", rec.Seq, err)
+			}
+			evt.PrivRelevantPds = relevant
+
+			if rec.BlocksCompressed && evt.RepoCommit != nil {
+				blocks, err := DecompressBlocks(evt.RepoCommit.Blocks)
+				if err != nil {
+					return fmt.Errorf("decoding event %d: %w", rec.Seq, err)
+				}
+				evt.RepoCommit.Blocks = blocks
+			}
+
+			if err := cb(&evt); err != nil {
+				return err
+			}
+			since = rec.Seq
+		}
+
+		if len(recs) < sqlitePlaybackPage {
+			return nil
+		}
+	}
+}
+
+func (p *SQLitePersistence) LatestSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	if err := p.db.WithContext(ctx).Model(SQLiteEventRecord{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error; err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (p *SQLitePersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	if err := p.db.WithContext(ctx).Model(SQLiteEventRecord{}).Select("coalesce(min(seq), 0)").Scan(&seq).Error; err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// Prune deletes all events with a seq lower than before, returning the number
+// of events removed.
+func (p *SQLitePersistence) Prune(ctx context.Context, before int64) (int64, error) {
+	res := p.db.WithContext(ctx).Where("seq < ?", before).Delete(&SQLiteEventRecord{})
+	return res.RowsAffected, res.Error
+}
+
+// PruneOlderThan deletes all events persisted more than age ago, returning
+// the number of events removed.
+func (p *SQLitePersistence) PruneOlderThan(ctx context.Context, age time.Duration) (int64, error) {
+	res := p.db.WithContext(ctx).Where("created_at < ?", time.Now().Add(-age)).Delete(&SQLiteEventRecord{})
+	return res.RowsAffected, res.Error
+}
+
+func (p *SQLitePersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	return p.db.WithContext(ctx).Where("uid = ?", usr).Delete(&SQLiteEventRecord{}).Error
+}
@@ -0,0 +1,281 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	cid "github.com/ipfs/go-cid"
+)
+
+func sqliteHandle(seq int64) *XRPCStreamEvent {
+	return &XRPCStreamEvent{
+		RepoHandle: &comatproto.SyncSubscribeRepos_Handle{
+			Seq:    seq,
+			Did:    fmt.Sprintf("did:plc:%d", seq),
+			Handle: fmt.Sprintf("h%d.example.com", seq),
+			Time:   "2024-01-01T00:00:00.000Z",
+		},
+	}
+}
+
+func openSQLite(t *testing.T, path string) *SQLitePersistence {
+	t.Helper()
+	return openSQLiteWithOpts(t, path, nil)
+}
+
+func openSQLiteWithOpts(t *testing.T, path string, opts *SQLiteOpts) *SQLitePersistence {
+	t.Helper()
+	p, err := NewSQLitePersistenceWithOpts(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := p.db.DB(); err == nil {
+			db.Close()
+		}
+	})
+	return p
+}
+
+func sqliteSeqs(t *testing.T, p *SQLitePersistence, since int64) []int64 {
+	t.Helper()
+	var seqs []int64
+	if err := p.Playback(context.Background(), since, func(e *XRPCStreamEvent) error {
+		seqs = append(seqs, e.sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	p := openSQLite(t, filepath.Join(t.TempDir(), "events.db"))
+
+	in := sqliteHandle(7)
+	in.PrivUid = 42
+	seq, err := p.Persist(ctx, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 7 {
+		t.Fatalf("expected the event's own seq 7, got %d", seq)
+	}
+
+	var out []*XRPCStreamEvent
+	if err := p.Playback(ctx, 0, func(e *XRPCStreamEvent) error {
+		out = append(out, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("expected one event back, got %d", len(out))
+	}
+	got := out[0]
+	if got.RepoHandle == nil || *got.RepoHandle != *in.RepoHandle {
+		t.Fatalf("expected %+v back, got %+v", in.RepoHandle, got.RepoHandle)
+	}
+	if got.PrivUid != 42 {
+		t.Fatalf("expected uid 42 back, got %d", got.PrivUid)
+	}
+}
+
+func TestSQLiteResumesSeqOnReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+
+	p := openSQLite(t, path)
+	for i := 0; i < 3; i++ {
+		// unnumbered events get the next seq
+		if _, err := p.Persist(ctx, sqliteHandle(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db, err := p.db.DB(); err == nil {
+		db.Close()
+	}
+
+	p = openSQLite(t, path)
+	latest, err := p.LatestSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != 3 {
+		t.Fatalf("expected latest seq 3 after reopening, got %d", latest)
+	}
+
+	seq, err := p.Persist(ctx, sqliteHandle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 4 {
+		t.Fatalf("expected numbering to resume at 4, got %d", seq)
+	}
+	if got := fmt.Sprint(sqliteSeqs(t, p, 0)); got != "[1 2 3 4]" {
+		t.Fatalf("expected [1 2 3 4], got %s", got)
+	}
+}
+
+func TestSQLitePlaybackPages(t *testing.T) {
+	ctx := context.Background()
+	p := openSQLite(t, filepath.Join(t.TempDir(), "events.db"))
+
+	// enough to take a few pages, ending part way through one
+	n := 2*sqlitePlaybackPage + 7
+	es := make([]*XRPCStreamEvent, n)
+	for i := range es {
+		es[i] = sqliteHandle(int64(i + 1))
+	}
+	if err := p.PersistBatch(ctx, es); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, since := range []int64{0, sqlitePlaybackPage - 1, sqlitePlaybackPage, sqlitePlaybackPage + 1, int64(n)} {
+		seqs := sqliteSeqs(t, p, since)
+		if want := n - int(since); len(seqs) != want {
+			t.Fatalf("since %d: expected %d events, got %d", since, want, len(seqs))
+		}
+		for i, seq := range seqs {
+			if seq != since+int64(i)+1 {
+				t.Fatalf("since %d: event %d has seq %d, expected %d", since, i, seq, since+int64(i)+1)
+			}
+		}
+	}
+}
+
+func TestSQLitePrune(t *testing.T) {
+	ctx := context.Background()
+	p := openSQLite(t, filepath.Join(t.TempDir(), "events.db"))
+
+	for seq := int64(1); seq <= 10; seq++ {
+		if _, err := p.Persist(ctx, sqliteHandle(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := p.Prune(ctx, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 events pruned, got %d", n)
+	}
+	if got := fmt.Sprint(sqliteSeqs(t, p, 0)); got != "[6 7 8 9 10]" {
+		t.Fatalf("expected [6 7 8 9 10] to remain, got %s", got)
+	}
+
+	earliest, err := p.EarliestSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if earliest != 6 {
+		t.Fatalf("expected earliest seq 6, got %d", earliest)
+	}
+
+	// nothing persisted a moment ago is older than an hour
+	if n, err := p.PruneOlderThan(ctx, time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected nothing pruned by age, got %d, %v", n, err)
+	}
+}
+
+func TestSQLiteFailedPersistKeepsSeq(t *testing.T) {
+	ctx := context.Background()
+	p := openSQLite(t, filepath.Join(t.TempDir(), "events.db"))
+
+	if _, err := p.Persist(ctx, sqliteHandle(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := p.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	single := sqliteHandle(0)
+	if _, err := p.Persist(ctx, single); err == nil {
+		t.Fatal("expected persisting to a closed database to fail")
+	}
+	batch := []*XRPCStreamEvent{sqliteHandle(0), sqliteHandle(0)}
+	if err := p.PersistBatch(ctx, batch); err == nil {
+		t.Fatal("expected persisting a batch to a closed database to fail")
+	}
+
+	if p.seq != 1 {
+		t.Fatalf("expected the seq counter to stay at 1 after failed writes, got %d", p.seq)
+	}
+	for _, e := range append(batch, single) {
+		if seq := e.sequence(); seq != 0 {
+			t.Fatalf("expected an event that failed to persist to be left unnumbered, got seq %d", seq)
+		}
+	}
+}
+
+func TestSQLiteCompressBlocks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+	blocks := bytes.Repeat([]byte("blocks "), 1000)
+	c, err := cid.Decode("bafyreidfayvfuwqa7qlnopdjiqrxzs6blmoeu4rujcjtnci5beludirz2a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(seq int64) *XRPCStreamEvent {
+		return &XRPCStreamEvent{
+			RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+				Seq:    seq,
+				Repo:   "did:plc:alice",
+				Commit: lexutil.LexLink(c),
+				Blocks: blocks,
+				Time:   "2024-01-01T00:00:00.000Z",
+			},
+		}
+	}
+
+	// the first commit is stored compressed, then the database is reopened
+	// with compression off for the second
+	on := openSQLiteWithOpts(t, path, &SQLiteOpts{CompressBlocks: true})
+	if _, err := on.Persist(ctx, commit(1)); err != nil {
+		t.Fatal(err)
+	}
+	off := openSQLite(t, path)
+	if _, err := off.Persist(ctx, commit(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []SQLiteEventRecord
+	if err := off.db.Order("seq").Find(&recs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || !recs[0].BlocksCompressed || recs[1].BlocksCompressed {
+		t.Fatalf("expected only the first of two records to be compressed, got %d records", len(recs))
+	}
+	if len(recs[0].Data) >= len(recs[1].Data) {
+		t.Fatalf("expected the compressed record to be smaller, got %d and %d bytes", len(recs[0].Data), len(recs[1].Data))
+	}
+
+	// either way, playback returns the blocks as they were
+	for _, p := range []*SQLitePersistence{on, off} {
+		n := 0
+		if err := p.Playback(ctx, 0, func(e *XRPCStreamEvent) error {
+			n++
+			if !bytes.Equal(e.RepoCommit.Blocks, blocks) {
+				t.Fatalf("event %d: blocks differ after playback", e.sequence())
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 events played back, got %d", n)
+		}
+	}
+}
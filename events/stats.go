@@ -0,0 +1,269 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SubscriberStats is a point-in-time snapshot of a single subscriber's
+// delivery state.
+type SubscriberStats struct {
+	ID   uint64
+	Name string
+
+	// Tail is set for subscribers registered by Tail, which are for
+	// ephemeral inspection rather than durable consumers, and drop events
+	// whenever they fall behind
+	Tail bool
+
+	// BufferLen and BufferCap describe the subscriber's outgoing channel,
+	// plus its delivery queue if it has one
+	BufferLen int
+	BufferCap int
+
+	// Dropped is the total number of events that could not be delivered
+	// because the buffer was full
+	Dropped int64
+
+	// Overflows is the number of distinct times the buffer filled up
+	Overflows int64
+
+	// Lag is the number of seqs between the most recent event broadcast and
+	// the last event this subscriber was either handed or filtered out
+	Lag int64
+
+	// Utilization is BufferLen / BufferCap, and UtilizationEWMA an
+	// exponentially weighted moving average of it, sampled every
+	// UtilizationSampleInterval. A consumer whose average stays high is
+	// persistently falling behind rather than absorbing a burst.
+	Utilization     float64
+	UtilizationEWMA float64
+
+	// DeliveredSeq is the seq of the last event delivered to the consumer,
+	// and SeqLag the number of seqs between it and the latest event
+	// broadcast, not counting events the subscriber wouldn't have received
+	// anyway. DeliveryDelay is the time between that event's Time and its
+	// delivery, zero if it has none. Events count as delivered once sent to
+	// the subscriber's channel, which with InlineDelivery is its whole
+	// buffer. The indigo_events_subscriber_seq_lag and
+	// indigo_events_subscriber_delivery_delay_seconds gauges report the same
+	// for named subscribers.
+	DeliveredSeq  int64
+	SeqLag        int64
+	DeliveryDelay time.Duration
+}
+
+// SubscriberInfo describes a registered subscriber.
+type SubscriberInfo struct {
+	ID          uint64
+	Name        string
+	BufferLen   int
+	BufferCap   int
+	ConnectedAt time.Time
+
+	// Tail is set for subscribers registered by Tail
+	Tail bool
+}
+
+func (s *Subscriber) bufferLen() int {
+	return len(s.outgoing) + len(s.queue)
+}
+
+func (s *Subscriber) bufferCap() int {
+	return cap(s.outgoing) + cap(s.queue)
+}
+
+func (s *Subscriber) bufferUtilization() float64 {
+	return float64(s.bufferLen()) / float64(s.bufferCap())
+}
+
+// utilizationWeight is the weight of each new sample in the utilization
+// average, so it mostly reflects the last few samples
+const utilizationWeight = 0.2
+
+// sampleUtilization folds each subscriber's current buffer utilization into
+// its moving average. It must be called from the run loop.
+func (em *EventManager) sampleUtilization() {
+	for _, s := range em.subs {
+		s.utilization += utilizationWeight * (s.bufferUtilization() - s.utilization)
+	}
+}
+
+// recordDelivery notes that evt was sent to the subscriber's outgoing
+// channel. Frames without a seq, such as pings, don't count.
+func (s *Subscriber) recordDelivery(evt *XRPCStreamEvent) {
+	if evt.sequence() == 0 {
+		return
+	}
+
+	s.delivered.Store(evt)
+	s.deliveredAt.Store(time.Now().UnixNano())
+}
+
+// deliveryLag is how far a subscriber's deliveries trail the stream.
+type deliveryLag struct {
+	seq   int64
+	delay time.Duration
+}
+
+// lag compares the subscriber's last delivery with latest, the most
+// recent seq broadcast. It only reads atomics and channel lengths, so it is
+// safe off the run loop.
+func (s *Subscriber) lag(latest int64) (int64, deliveryLag) {
+	var l deliveryLag
+	var seq int64
+	if evt := s.delivered.Load(); evt != nil {
+		seq = evt.sequence()
+		if t, ok := evt.eventTime(); ok {
+			l.delay = time.Unix(0, s.deliveredAt.Load()).Sub(t)
+		}
+	}
+
+	// a live subscriber with nothing buffered has been sent everything it
+	// was handed, and the rest was filtered out or meant for others
+	caughtUp := seq
+	if s.live.Load() && s.bufferLen() == 0 {
+		if len(s.uids) > 0 || len(s.pds) > 0 {
+			caughtUp = latest
+		} else if seen := s.lastSeq.Load(); seen > caughtUp {
+			caughtUp = seen
+		}
+	}
+
+	if l.seq = latest - caughtUp; l.seq < 0 {
+		l.seq = 0
+	}
+
+	return seq, l
+}
+
+// deliveryLags returns the worst delivery lag for each subscriber name.
+func (em *EventManager) deliveryLags() map[string]deliveryLag {
+	latest := em.latestSeq.Load()
+	out := make(map[string]deliveryLag)
+	em.tracked.Range(func(_, v any) bool {
+		s := v.(*Subscriber)
+		_, l := s.lag(latest)
+		if cur, ok := out[s.name]; ok {
+			if cur.seq > l.seq {
+				l.seq = cur.seq
+			}
+			if cur.delay > l.delay {
+				l.delay = cur.delay
+			}
+		}
+		out[s.name] = l
+		return true
+	})
+
+	return out
+}
+
+func (em *EventManager) subscriberStats() []SubscriberStats {
+	out := make([]SubscriberStats, 0, len(em.subs))
+	for _, s := range em.subs {
+		// restricted subscribers don't see events meant for other accounts
+		// or PDSes, so once live with nothing buffered they are caught up
+		lag := em.lastSeq - s.lastSeq.Load()
+		if (len(s.uids) > 0 || len(s.pds) > 0) && s.live.Load() && s.bufferLen() == 0 {
+			lag = 0
+		}
+
+		delivered, dl := s.lag(em.lastSeq)
+		out = append(out, SubscriberStats{
+			ID:        s.id,
+			Name:      s.name,
+			Tail:      s.tail,
+			BufferLen: s.bufferLen(),
+			BufferCap: s.bufferCap(),
+			Dropped:   s.dropped.Load(),
+			Overflows: s.overflows.Load(),
+			Lag:       lag,
+
+			Utilization:     s.bufferUtilization(),
+			UtilizationEWMA: s.utilization,
+
+			DeliveredSeq:  delivered,
+			SeqLag:        dl.seq,
+			DeliveryDelay: dl.delay,
+		})
+	}
+
+	return out
+}
+
+// query runs fn on the run loop, where it may safely read loop-owned state
+// such as the subscriber list, and waits for it to complete.
+func (em *EventManager) query(ctx context.Context, fn func()) error {
+	op := &Operation{
+		op:     opQuery,
+		query:  fn,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case em.ctrlOps <- op:
+	case <-em.closed:
+		return fmt.Errorf("event manager shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-op.result:
+		return nil
+	case <-em.runDone:
+		return fmt.Errorf("event manager shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SubscriberStats returns delivery statistics for every currently registered
+// subscriber. The query is answered by the Run loop, so it reflects a
+// consistent view of the subscriber set.
+func (em *EventManager) SubscriberStats(ctx context.Context) ([]SubscriberStats, error) {
+	var stats []SubscriberStats
+	if err := em.query(ctx, func() {
+		stats = em.subscriberStats()
+	}); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// SubscriberCount returns the number of currently registered subscribers.
+func (em *EventManager) SubscriberCount(ctx context.Context) (int, error) {
+	var n int
+	if err := em.query(ctx, func() {
+		n = len(em.subs)
+	}); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Subscribers lists the currently registered subscribers.
+func (em *EventManager) Subscribers(ctx context.Context) ([]SubscriberInfo, error) {
+	var out []SubscriberInfo
+	if err := em.query(ctx, func() {
+		out = make([]SubscriberInfo, 0, len(em.subs))
+		for _, s := range em.subs {
+			out = append(out, SubscriberInfo{
+				ID:          s.id,
+				Name:        s.name,
+				BufferLen:   s.bufferLen(),
+				BufferCap:   s.bufferCap(),
+				ConnectedAt: s.connectedAt,
+				Tail:        s.tail,
+			})
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,172 @@
+package events
+
+import (
+	"context"
+	"fmt"
+)
+
+// Subscription is a handle on a subscriber, returned by SubscribeHandle.
+type Subscription struct {
+	em    *EventManager
+	sub   *Subscriber
+	close func()
+}
+
+// Events returns the subscriber's outgoing channel, as returned by
+// SubscribeWithOpts.
+func (s *Subscription) Events() <-chan *XRPCStreamEvent {
+	return s.sub.outgoing
+}
+
+// Close unsubscribes. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.close()
+}
+
+// UpdateFilter replaces the subscription's filter; see
+// EventManager.UpdateFilter.
+func (s *Subscription) UpdateFilter(ctx context.Context, filter func(*XRPCStreamEvent) bool) error {
+	return s.em.UpdateFilter(ctx, s, filter)
+}
+
+// UpdateFilter replaces a live subscription's filter, for consumers whose
+// interests change at runtime, without a reconnect and replay. A nil filter
+// accepts every event. The swap is made by the run loop between broadcasts,
+// so each live event is checked against either the old filter or the new
+// one, and it returns once the new filter is in place. Events already
+// buffered for the subscriber were accepted by the old filter and are still
+// delivered. If the subscription is still catching up, playback switches to
+// the new filter from the next event it reads. Kinds, Pds and Uids
+// restrictions from SubscribeOpts still apply.
+func (em *EventManager) UpdateFilter(ctx context.Context, sub *Subscription, filter func(*XRPCStreamEvent) bool) error {
+	select {
+	case <-sub.sub.done:
+		return fmt.Errorf("subscription is closed")
+	default:
+	}
+
+	return em.submit(ctx, &Operation{
+		op:     opUpdateFilter,
+		sub:    sub.sub,
+		filter: filter,
+	}, true)
+}
+
+func (s *Subscriber) setFilter(filter func(*XRPCStreamEvent) bool) {
+	if filter == nil {
+		s.filter.Store(nil)
+		return
+	}
+
+	s.filter.Store(&filter)
+}
+
+// GrantCredits lets a subscription with SubscribeOpts.FlowControl be sent n
+// more events, resuming delivery if it had paused for want of credits.
+// Credits accumulate, so a consumer may grant its next batch before it has
+// taken the whole of the last. It has no effect on subscriptions without
+// flow control.
+func (s *Subscription) GrantCredits(n int) {
+	if !s.sub.flowControl || n <= 0 {
+		return
+	}
+
+	s.sub.credits.Add(int64(n))
+	select {
+	case s.sub.creditc <- struct{}{}:
+	default:
+	}
+}
+
+// awaitCredit takes a credit for the next event played back to a subscriber
+// with flow control, waiting for the consumer to grant one if need be. It
+// returns false if the subscriber or manager goes away first.
+func (em *EventManager) awaitCredit(s *Subscriber) bool {
+	if !s.flowControl {
+		return true
+	}
+
+	for s.credits.Load() <= 0 {
+		select {
+		case <-s.creditc:
+		case <-s.done:
+			return false
+		case <-em.closed:
+			return false
+		}
+	}
+
+	s.credits.Add(-1)
+	return true
+}
+
+// Errors returns a channel that receives the reason the subscription ended,
+// if it wasn't closed by the consumer, and is then closed; see Err.
+func (s *Subscription) Errors() <-chan error {
+	return s.sub.errc
+}
+
+// Err returns why the subscription ended once its events channel is closed,
+// so the consumer can tell whether to reconnect and replay from its cursor
+// or give up: a ConsumerTooSlow StreamError if it was evicted, a
+// PlaybackFailed one if catching up from its cursor failed, a FutureCursor
+// one if its cursor was ahead of the stream, or ErrManagerShutdown. It is nil
+// while the subscription is running and after Close.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.sub.ended:
+		return s.sub.err
+	default:
+		return nil
+	}
+}
+
+// end records why the subscription ended. Only the first reason counts, so
+// specific causes are recorded before the channel is closed and win over
+// the generic ones found when it is.
+func (s *Subscriber) end(err error) {
+	s.endOnce.Do(func() {
+		s.err = err
+		if err != nil {
+			s.errc <- err
+		}
+		close(s.ended)
+		close(s.errc)
+	})
+}
+
+// finish closes the subscriber's outgoing channel, first discarding what is
+// buffered if the manager is abandoning buffered events. The caller must be
+// its only writer.
+func (em *EventManager) finish(s *Subscriber) {
+	select {
+	case <-em.closed:
+		s.end(ErrManagerShutdown)
+	default:
+		s.end(nil)
+	}
+
+	select {
+	case <-em.dropping:
+		em.discard(s)
+	default:
+	}
+
+	close(s.outgoing)
+	close(s.finished)
+}
+
+// abandonPlayback ends a subscription that is still catching up, on behalf
+// of its playback goroutine.
+func (em *EventManager) abandonPlayback(sub *Subscriber, err error) {
+	sub.end(err)
+	select {
+	case em.ctrlOps <- &Operation{
+		op:  opUnsubscribe,
+		sub: sub,
+	}:
+	case <-em.closed:
+	}
+
+	em.finish(sub)
+}
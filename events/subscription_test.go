@@ -0,0 +1,119 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+// takeSeqs reads the seqs of the next n events from sub, failing if any more
+// arrive shortly after.
+func takeSeqs(t *testing.T, ctx context.Context, sub *Subscription, n int) []int64 {
+	t.Helper()
+
+	var seqs []int64
+	for len(seqs) < n {
+		select {
+		case e := <-sub.Events():
+			seqs = append(seqs, e.sequence())
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %d events, got %v", n, seqs)
+		}
+	}
+
+	select {
+	case e := <-sub.Events():
+		t.Fatalf("expected only %v, also got %d", seqs, e.sequence())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	return seqs
+}
+
+func expectSeqs(t *testing.T, got []int64, from, to int64) {
+	t.Helper()
+	if len(got) != int(to-from+1) {
+		t.Fatalf("expected seqs %d through %d, got %v", from, to, got)
+	}
+	for i, seq := range got {
+		if seq != from+int64(i) {
+			t.Fatalf("expected seqs %d through %d, got %v", from, to, got)
+		}
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		inline := inline
+		t.Run(fmt.Sprintf("inline=%v", inline), func(t *testing.T) {
+			testFlowControl(t, inline)
+		})
+	}
+}
+
+func testFlowControl(t *testing.T, inline bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := NewEventManagerWithOpts(NewMemPersister(), &EventManagerOpts{
+		AssignSeq:      true,
+		InlineDelivery: inline,
+	})
+	go em.Run(ctx)
+	defer em.Shutdown(context.Background())
+
+	add := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := em.AddEventSync(ctx, &XRPCStreamEvent{
+				RepoHandle: &comatproto.SyncSubscribeRepos_Handle{Did: "did:plc:credits", Handle: "test.example.com"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	all := func(*XRPCStreamEvent) bool { return true }
+	paced, err := em.SubscribeHandle(ctx, all, nil, &SubscribeOpts{FlowControl: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, err := em.SubscribeHandle(ctx, all, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without credits nothing is sent, while other subscribers carry on
+	add(5)
+	expectSeqs(t, takeSeqs(t, ctx, free, 5), 1, 5)
+	takeSeqs(t, ctx, paced, 0)
+
+	// each grant lets through that many of the waiting events, in order
+	paced.GrantCredits(2)
+	expectSeqs(t, takeSeqs(t, ctx, paced, 2), 1, 2)
+
+	// and credits granted ahead of events are there when they arrive
+	paced.GrantCredits(6)
+	expectSeqs(t, takeSeqs(t, ctx, paced, 3), 3, 5)
+	add(4)
+	expectSeqs(t, takeSeqs(t, ctx, paced, 3), 6, 8)
+
+	paced.GrantCredits(1)
+	expectSeqs(t, takeSeqs(t, ctx, paced, 1), 9, 9)
+	expectSeqs(t, takeSeqs(t, ctx, free, 4), 6, 9)
+
+	// playback is paced the same way, starting from InitialCredits
+	since := int64(0)
+	replay, err := em.SubscribeHandle(ctx, all, &since, &SubscribeOpts{FlowControl: true, InitialCredits: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSeqs(t, takeSeqs(t, ctx, replay, 3), 1, 3)
+
+	replay.GrantCredits(100)
+	add(1)
+	expectSeqs(t, takeSeqs(t, ctx, replay, 7), 4, 10)
+}
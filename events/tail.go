@@ -0,0 +1,31 @@
+package events
+
+import (
+	"context"
+)
+
+// tailBufferSize is the buffer of Tail subscribers, enough to absorb a burst
+// while a terminal scrolls but no more
+const tailBufferSize = 64
+
+// Tail subscribes to the live stream for ephemeral inspection, say by an
+// admin tool watching what a relay is broadcasting, returning the events and
+// a func to stop tailing. It is a lightweight subscriber named "tail", with
+// a small buffer and no filter, cursor or eviction: whatever arrives while
+// the buffer is full is dropped. Tail subscribers are flagged Tail in
+// SubscriberStats and Subscribers, and are left out of Pressure, the dropped
+// events metric and the delivery lag metrics, so an idle terminal is never
+// mistaken for a consumer falling behind. Use Subscribe for anything that
+// needs every event.
+func (em *EventManager) Tail(ctx context.Context) (<-chan *XRPCStreamEvent, func(), error) {
+	sub, err := em.SubscribeHandle(ctx, nil, nil, &SubscribeOpts{
+		Name:       "tail",
+		BufferSize: tailBufferSize,
+		tail:       true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sub.Events(), sub.Close, nil
+}
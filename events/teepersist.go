@@ -0,0 +1,214 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// TeePersistence persists every event to several persisters, say a database
+// for durability and a local file for quick inspection, or an old and a new
+// backend during a migration. The first persister is the primary: it numbers
+// events that arrive without a seq, so the others store the same seqs, and
+// it alone serves Playback and the seq queries. The others are mirrors.
+//
+// An event the primary fails to persist is not passed to the mirrors. If a
+// mirror fails after the primary succeeded, the mirror has diverged, which
+// is reported as a *TeeError naming it. By default that is returned as an
+// error, so the manager treats the event as failing to persist even though
+// it can be played back from the primary; with TeeOpts.TolerateMirrorErrors
+// it is only logged.
+//
+// Optional interfaces such as Pruner and LabelSnapshotter are not forwarded.
+type TeePersistence struct {
+	primary EventPersistence
+	mirrors []EventPersistence
+
+	tolerateMirrorErrors bool
+}
+
+// TeeOpts holds optional TeePersistence settings.
+type TeeOpts struct {
+	// TolerateMirrorErrors logs mirror failures instead of returning them,
+	// for mirrors that are a convenience rather than a requirement.
+	TolerateMirrorErrors bool
+}
+
+// TeeError reports the mirrors that failed an operation the primary
+// completed. They are missing its effect until repaired.
+type TeeError struct {
+	Op     string
+	Failed []TeeFailure
+}
+
+// TeeFailure is a single mirror's failure.
+type TeeFailure struct {
+	// Index is the mirror's position among the persisters passed to
+	// NewTeePersistence, counting the primary as 0
+	Index     int
+	Persister EventPersistence
+	Err       error
+}
+
+func (e *TeeError) Error() string {
+	parts := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		parts = append(parts, fmt.Sprintf("persister %d (%T): %s", f.Index, f.Persister, f.Err))
+	}
+
+	return fmt.Sprintf("tee %s diverged: %s", e.Op, strings.Join(parts, "; "))
+}
+
+func (e *TeeError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		errs = append(errs, f.Err)
+	}
+
+	return errs
+}
+
+func NewTeePersistence(persisters ...EventPersistence) *TeePersistence {
+	return NewTeePersistenceWithOpts(nil, persisters...)
+}
+
+// NewTeePersistenceWithOpts is NewTeePersistence with options. It panics if
+// no persisters are given.
+func NewTeePersistenceWithOpts(opts *TeeOpts, persisters ...EventPersistence) *TeePersistence {
+	if len(persisters) == 0 {
+		panic("events: TeePersistence needs at least one persister")
+	}
+
+	if opts == nil {
+		opts = &TeeOpts{}
+	}
+
+	return &TeePersistence{
+		primary:              persisters[0],
+		mirrors:              persisters[1:],
+		tolerateMirrorErrors: opts.TolerateMirrorErrors,
+	}
+}
+
+// mirror runs fn against every mirror, collecting failures into a *TeeError
+// which is returned or logged depending on TolerateMirrorErrors.
+func (p *TeePersistence) mirror(op string, fn func(EventPersistence) error) error {
+	var failed []TeeFailure
+	for i, m := range p.mirrors {
+		if err := fn(m); err != nil {
+			failed = append(failed, TeeFailure{Index: i + 1, Persister: m, Err: err})
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	terr := &TeeError{Op: op, Failed: failed}
+	if p.tolerateMirrorErrors {
+		log.Warnw("event persister mirror diverged", "err", terr)
+		return nil
+	}
+
+	return terr
+}
+
+func (p *TeePersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	seq, err := p.primary.Persist(ctx, e)
+	if err != nil {
+		return 0, err
+	}
+
+	// the primary stamped any seq it assigned, so mirrors store the same one
+	return seq, p.mirror(fmt.Sprintf("persist of %s event %d", e.kind(), seq), func(m EventPersistence) error {
+		_, err := m.Persist(ctx, e)
+		return err
+	})
+}
+
+func (p *TeePersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	if err := p.primary.PersistBatch(ctx, es); err != nil {
+		return err
+	}
+
+	return p.mirror(fmt.Sprintf("persist of %d event batch", len(es)), func(m EventPersistence) error {
+		return m.PersistBatch(ctx, es)
+	})
+}
+
+// BeginBatch runs the batch in a transaction on the primary only. Once it
+// commits, the events are passed to the mirrors with PersistBatch.
+func (p *TeePersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	tx, err := p.primary.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &teeBatch{p: p, tx: tx}, nil
+}
+
+type teeBatch struct {
+	p   *TeePersistence
+	tx  BatchTx
+	evs []*XRPCStreamEvent
+}
+
+func (b *teeBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	seq, err := b.tx.Persist(ctx, e)
+	if err != nil {
+		return 0, err
+	}
+
+	b.evs = append(b.evs, e)
+
+	return seq, nil
+}
+
+func (b *teeBatch) Commit(ctx context.Context) error {
+	if err := b.tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return b.p.mirror(fmt.Sprintf("persist of %d event batch", len(b.evs)), func(m EventPersistence) error {
+		return m.PersistBatch(ctx, b.evs)
+	})
+}
+
+func (b *teeBatch) Rollback(ctx context.Context) error {
+	return b.tx.Rollback(ctx)
+}
+
+func (p *TeePersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.primary.Playback(ctx, since, cb)
+}
+
+func (p *TeePersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.primary.PlaybackByDID(ctx, did, since, cb)
+}
+
+func (p *TeePersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return p.primary.PlaybackByTime(ctx, from, to, cb)
+}
+
+// TakeDownRepo takes the repo down from every persister, including mirrors
+// that don't support takedowns, which then report a divergence.
+func (p *TeePersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	if err := p.primary.TakeDownRepo(ctx, usr); err != nil {
+		return err
+	}
+
+	return p.mirror(fmt.Sprintf("takedown of %d", usr), func(m EventPersistence) error {
+		return m.TakeDownRepo(ctx, usr)
+	})
+}
+
+func (p *TeePersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	return p.primary.EarliestSeq(ctx)
+}
+
+func (p *TeePersistence) LatestSeq(ctx context.Context) (int64, error) {
+	return p.primary.LatestSeq(ctx)
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+// TooBigResolver fetches the blocks left out of a commit flagged TooBig,
+// typically from the repo store, as the CAR slice the commit's Blocks would
+// have held.
+type TooBigResolver func(ctx context.Context, commit *comatproto.SyncSubscribeRepos_Commit) ([]byte, error)
+
+const defaultTooBigConcurrency = 4
+
+// hydrate resolves the blocks of a TooBig commit for a subscriber with a
+// resolver, returning a copy of evt carrying them, or evt itself if there is
+// nothing to resolve or resolving fails, in which case the consumer gets the
+// event as it was. It runs on the subscriber's delivery goroutine, or its
+// playback, so a slow resolver only holds up that subscriber; the manager's
+// semaphore bounds how many resolves run at once across all of them. It
+// returns nil if the subscriber goes away or the manager abandons buffered
+// events while waiting.
+func (em *EventManager) hydrate(s *Subscriber, evt *XRPCStreamEvent) *XRPCStreamEvent {
+	if s.resolveTooBig == nil || evt.RepoCommit == nil || !evt.RepoCommit.TooBig {
+		return evt
+	}
+
+	select {
+	case em.tooBigSem <- struct{}{}:
+	case <-s.done:
+		return nil
+	case <-em.dropping:
+		return nil
+	}
+	defer func() { <-em.tooBigSem }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+		case <-em.dropping:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	blocks, err := s.resolveTooBig(ctx, evt.RepoCommit)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		em.log.Warnw("failed to resolve blocks of too big commit, delivering it as is", "err", err, "sub", s.id, "name", s.name, "seq", evt.sequence(), "repo", evt.RepoCommit.Repo)
+		return evt
+	}
+
+	out := evt.withBlocks(blocks)
+	out.RepoCommit.TooBig = false
+	if s.compressBlocks && out.hasBlocks() {
+		out = em.compressBlocks(out)
+	}
+
+	return out
+}
@@ -0,0 +1,191 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	label "github.com/bluesky-social/indigo/api/label"
+	cid "github.com/ipfs/go-cid"
+)
+
+// ValidationMode controls how AddEvent treats events that fail ValidateEvent.
+type ValidationMode int
+
+const (
+	// ValidateNone skips validation entirely. This is the default.
+	ValidateNone ValidationMode = iota
+
+	// ValidateWarn logs invalid events but still persists and broadcasts
+	// them, which is useful for finding misbehaving producers before turning
+	// on ValidateStrict.
+	ValidateWarn
+
+	// ValidateStrict rejects invalid events; AddEvent returns the
+	// validation error and the event is never persisted or broadcast.
+	ValidateStrict
+)
+
+// ErrInvalidEvent is wrapped by all errors returned from ValidateEvent.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// didPattern is a loose check of the did:<method>:<identifier> syntax
+var didPattern = regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`)
+
+// ValidationRules selects the checks ValidatingPersistence makes.
+type ValidationRules struct {
+	// DIDs checks that the account of repo events, and the src of labels,
+	// look like DIDs
+	DIDs bool
+
+	// Times checks that the time of repo events, and the cts of labels,
+	// are RFC 3339
+	Times bool
+
+	// Seqs rejects events with negative seqs
+	Seqs bool
+
+	// CIDs checks that commits carry a commit CID, that any prev or op CID
+	// they carry is defined, and that label CIDs parse
+	CIDs bool
+}
+
+// AllValidationRules enables every check.
+var AllValidationRules = ValidationRules{
+	DIDs:  true,
+	Times: true,
+	Seqs:  true,
+	CIDs:  true,
+}
+
+// ValidateEvent performs a basic schema check of a repo event: the account
+// must look like a DID, the seq must not be negative, the time must be
+// RFC 3339, and for commits the commit CID must be set, any prev or op CID
+// must be defined, and every op must be a create, update or delete. Label,
+// info and error frames are not checked.
+func ValidateEvent(evt *XRPCStreamEvent) error {
+	if err := validateEvent(evt, AllValidationRules); err != nil {
+		return fmt.Errorf("%w: %s event: %s", ErrInvalidEvent, evt.kind(), err)
+	}
+
+	return nil
+}
+
+func validateEvent(evt *XRPCStreamEvent, rules ValidationRules) error {
+	switch {
+	case evt.RepoCommit != nil:
+		c := evt.RepoCommit
+		if err := validateCommon(c.Repo, c.Seq, c.Time, rules); err != nil {
+			return err
+		}
+
+		if rules.CIDs {
+			if !c.Commit.Defined() {
+				return fmt.Errorf("missing commit cid")
+			}
+
+			if c.Prev != nil && !c.Prev.Defined() {
+				return fmt.Errorf("undefined prev cid")
+			}
+		}
+
+		for i, op := range c.Ops {
+			if op == nil {
+				return fmt.Errorf("op %d is nil", i)
+			}
+
+			switch op.Action {
+			case "create", "update", "delete":
+			default:
+				return fmt.Errorf("op %d (%s) has invalid action %q", i, op.Path, op.Action)
+			}
+
+			if rules.CIDs && op.Cid != nil && !op.Cid.Defined() {
+				return fmt.Errorf("op %d (%s) has undefined cid", i, op.Path)
+			}
+		}
+
+		return nil
+	case evt.RepoHandle != nil:
+		return validateCommon(evt.RepoHandle.Did, evt.RepoHandle.Seq, evt.RepoHandle.Time, rules)
+	case evt.RepoMigrate != nil:
+		return validateCommon(evt.RepoMigrate.Did, evt.RepoMigrate.Seq, evt.RepoMigrate.Time, rules)
+	case evt.RepoTombstone != nil:
+		return validateCommon(evt.RepoTombstone.Did, evt.RepoTombstone.Seq, evt.RepoTombstone.Time, rules)
+	case evt.RepoIdentity != nil:
+		return validateCommon(evt.RepoIdentity.Did, evt.RepoIdentity.Seq, evt.RepoIdentity.Time, rules)
+	case evt.RepoAccount != nil:
+		return validateCommon(evt.RepoAccount.Did, evt.RepoAccount.Seq, evt.RepoAccount.Time, rules)
+	default:
+		return nil
+	}
+}
+
+func validateCommon(did string, seq int64, t string, rules ValidationRules) error {
+	if rules.DIDs && !didPattern.MatchString(did) {
+		return fmt.Errorf("invalid did %q", did)
+	}
+
+	if rules.Seqs && seq < 0 {
+		return fmt.Errorf("negative seq %d", seq)
+	}
+
+	if rules.Times {
+		if _, err := time.Parse(time.RFC3339, t); err != nil {
+			return fmt.Errorf("invalid time %q", t)
+		}
+	}
+
+	return nil
+}
+
+// validateLabels checks a label batch, which ValidateEvent leaves alone.
+func validateLabels(batch *label.SubscribeLabels_Labels, rules ValidationRules) error {
+	if rules.Seqs && batch.Seq < 0 {
+		return fmt.Errorf("negative seq %d", batch.Seq)
+	}
+
+	for i, l := range batch.Labels {
+		if l == nil {
+			return fmt.Errorf("label %d is nil", i)
+		}
+
+		if rules.DIDs && !didPattern.MatchString(l.Src) {
+			return fmt.Errorf("label %d has invalid src %q", i, l.Src)
+		}
+
+		if rules.Times {
+			if _, err := time.Parse(time.RFC3339, l.Cts); err != nil {
+				return fmt.Errorf("label %d has invalid cts %q", i, l.Cts)
+			}
+		}
+
+		if rules.CIDs && l.Cid != nil {
+			if _, err := cid.Decode(*l.Cid); err != nil {
+				return fmt.Errorf("label %d has invalid cid %q", i, *l.Cid)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate applies the manager's validation mode to evt.
+func (em *EventManager) validate(evt *XRPCStreamEvent) error {
+	if em.validation == ValidateNone {
+		return nil
+	}
+
+	err := ValidateEvent(evt)
+	if err == nil {
+		return nil
+	}
+
+	if em.validation == ValidateStrict {
+		return ErrInvalidEventFrame(err)
+	}
+
+	em.log.Warnw("broadcasting invalid event", "err", err, "seq", evt.sequence())
+	return nil
+}
@@ -0,0 +1,123 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// ValidatingPersistence checks every event before passing it on to another
+// persister, rejecting those that fail with an error wrapping
+// ErrInvalidEvent, so that whatever the producer, nothing malformed reaches
+// the durable log. It makes the checks ValidateEvent does, as selected by its
+// ValidationRules, and also checks the labels of label batches. Everything
+// other than persisting is passed straight through.
+//
+// Unlike EventManagerOpts.Validation, which only covers events added through
+// one manager, it guards the persister itself. Optional interfaces such as
+// Pruner and LabelSnapshotter are not forwarded.
+type ValidatingPersistence struct {
+	inner EventPersistence
+	rules ValidationRules
+}
+
+// NewValidatingPersistence wraps inner, checking events against rules. nil
+// rules mean AllValidationRules.
+func NewValidatingPersistence(inner EventPersistence, rules *ValidationRules) *ValidatingPersistence {
+	if rules == nil {
+		rules = &AllValidationRules
+	}
+
+	return &ValidatingPersistence{
+		inner: inner,
+		rules: *rules,
+	}
+}
+
+func (p *ValidatingPersistence) validate(e *XRPCStreamEvent) error {
+	err := validateEvent(e, p.rules)
+	if err == nil && e.LabelLabels != nil {
+		err = validateLabels(e.LabelLabels, p.rules)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s event %d: %s", ErrInvalidEvent, e.kind(), e.sequence(), err)
+	}
+
+	return nil
+}
+
+func (p *ValidatingPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	if err := p.validate(e); err != nil {
+		return 0, err
+	}
+
+	return p.inner.Persist(ctx, e)
+}
+
+// PersistBatch checks the whole batch before persisting any of it, so an
+// invalid event anywhere in it leaves the inner persister untouched.
+func (p *ValidatingPersistence) PersistBatch(ctx context.Context, es []*XRPCStreamEvent) error {
+	for _, e := range es {
+		if err := p.validate(e); err != nil {
+			return err
+		}
+	}
+
+	return p.inner.PersistBatch(ctx, es)
+}
+
+func (p *ValidatingPersistence) BeginBatch(ctx context.Context) (BatchTx, error) {
+	tx, err := p.inner.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &validatingBatch{p: p, tx: tx}, nil
+}
+
+type validatingBatch struct {
+	p  *ValidatingPersistence
+	tx BatchTx
+}
+
+func (b *validatingBatch) Persist(ctx context.Context, e *XRPCStreamEvent) (int64, error) {
+	if err := b.p.validate(e); err != nil {
+		return 0, err
+	}
+
+	return b.tx.Persist(ctx, e)
+}
+
+func (b *validatingBatch) Commit(ctx context.Context) error {
+	return b.tx.Commit(ctx)
+}
+
+func (b *validatingBatch) Rollback(ctx context.Context) error {
+	return b.tx.Rollback(ctx)
+}
+
+func (p *ValidatingPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.inner.Playback(ctx, since, cb)
+}
+
+func (p *ValidatingPersistence) PlaybackByDID(ctx context.Context, did string, since int64, cb func(*XRPCStreamEvent) error) error {
+	return p.inner.PlaybackByDID(ctx, did, since, cb)
+}
+
+func (p *ValidatingPersistence) PlaybackByTime(ctx context.Context, from, to time.Time, cb func(*XRPCStreamEvent) error) error {
+	return p.inner.PlaybackByTime(ctx, from, to, cb)
+}
+
+func (p *ValidatingPersistence) TakeDownRepo(ctx context.Context, usr util.Uid) error {
+	return p.inner.TakeDownRepo(ctx, usr)
+}
+
+func (p *ValidatingPersistence) EarliestSeq(ctx context.Context) (int64, error) {
+	return p.inner.EarliestSeq(ctx)
+}
+
+func (p *ValidatingPersistence) LatestSeq(ctx context.Context) (int64, error) {
+	return p.inner.LatestSeq(ctx)
+}
@@ -0,0 +1,165 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error frame names sent by ServeSubscription when a subscription can't be
+// started.
+const (
+	ErrorInvalidRequest     = "InvalidRequest"
+	ErrorTooManySubscribers = "TooManySubscribers"
+	ErrorInternal           = "InternalError"
+)
+
+// SubscriptionHandler returns an http.Handler that upgrades requests to a
+// WebSocket and streams events to them with ServeSubscription. It accepts
+// the usual subscription query parameters:
+//
+//   - cursor: the last seq the client has seen; omit to start at the live tail
+//   - wantedDids: only send events for these DIDs (see FilterByDIDs)
+//   - wantedCollections: only send commits touching these collections (see
+//     FilterByCollections)
+//
+// The filter parameters may be repeated or given as comma separated lists.
+// Invalid parameters are reported to the client as an ErrorInvalidRequest
+// error frame.
+func (em *EventManager) SubscriptionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, w.Header(), 1<<10, 1<<10)
+		if err != nil {
+			em.log.Warnw("upgrading subscription websocket", "err", err)
+			return
+		}
+		defer conn.Close()
+
+		since, filter, err := parseSubscriptionParams(r)
+		if err != nil {
+			em.writeErrorFrame(conn, &StreamError{Name: ErrorInvalidRequest, Message: err.Error()})
+			return
+		}
+
+		if err := em.ServeSubscription(r.Context(), conn, filter, since); err != nil {
+			em.log.Infow("subscription websocket closed", "err", err, "remote", r.RemoteAddr)
+		}
+	})
+}
+
+func parseSubscriptionParams(r *http.Request) (*int64, func(*XRPCStreamEvent) bool, error) {
+	q := r.URL.Query()
+
+	var since *int64
+	if v := q.Get("cursor"); v != "" {
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cursor %q", v)
+		}
+		since = &seq
+	}
+
+	var filters []func(*XRPCStreamEvent) bool
+	if dids := listParam(q["wantedDids"]); len(dids) > 0 {
+		filters = append(filters, FilterByDIDs(dids...))
+	}
+	if nsids := listParam(q["wantedCollections"]); len(nsids) > 0 {
+		filters = append(filters, FilterByCollections(nsids...))
+	}
+
+	return since, All(filters...), nil
+}
+
+// listParam flattens repeated and comma separated query values.
+func listParam(vals []string) []string {
+	var out []string
+	for _, v := range vals {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+
+	return out
+}
+
+// ServeSubscription subscribes with the given filter and cursor and writes
+// each event to conn as a binary message framed by MarshalFrames, until the
+// client goes away, ctx is cancelled or the event manager shuts down. If the
+// subscription can't be started, or ends because the client was evicted,
+// playback failed or the manager shut down, the client is sent an error
+// frame and the reason is returned. The subscription is always cleaned up
+// before returning, but closing conn is left to the caller.
+func (em *EventManager) ServeSubscription(ctx context.Context, conn *websocket.Conn, filter func(*XRPCStreamEvent) bool, since *int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub, err := em.SubscribeHandle(ctx, filter, since, nil)
+	if err != nil {
+		em.writeErrorFrame(conn, AsStreamError(err))
+		return err
+	}
+	defer sub.Close()
+	evts := sub.Events()
+
+	// the client never sends us anything meaningful, but we have to keep
+	// reading to handle control frames and to notice when it disconnects
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case evt, ok := <-evts:
+			if !ok {
+				// future cursors have already been sent their error frame
+				err := sub.Err()
+				var serr *StreamError
+				if errors.As(err, &serr) && serr.Name != ErrorFutureCursor {
+					em.writeErrorFrame(conn, serr)
+				}
+				return err
+			}
+
+			if err := writeFrame(conn, evt); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func writeFrame(conn *websocket.Conn, evt *XRPCStreamEvent) error {
+	wc, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	if err := evt.MarshalFrames(wc); err != nil {
+		return err
+	}
+
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("failed to flush-close our event write: %w", err)
+	}
+
+	return nil
+}
+
+func (em *EventManager) writeErrorFrame(conn *websocket.Conn, serr *StreamError) {
+	if err := writeFrame(conn, serr.Frame()); err != nil {
+		em.log.Warnw("failed to write error frame", "err", err, "error", serr.Name)
+	}
+}
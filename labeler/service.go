@@ -117,7 +117,7 @@ func NewServer(db *gorm.DB, cs *carstore.CarStore, repoUser RepoConfig, plcURL,
 	}
 	s.bgsSlurper = slurp
 
-	go evtmgr.Run()
+	go evtmgr.Run(ctx)
 
 	return s, nil
 }
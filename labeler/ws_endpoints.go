@@ -5,7 +5,6 @@ import (
 	"strconv"
 
 	"github.com/bluesky-social/indigo/events"
-	lexutil "github.com/bluesky-social/indigo/lex/util"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -36,37 +35,21 @@ func (s *Server) EventsLabelsWebsocket(c echo.Context) error {
 	}
 	defer cancel()
 
-	header := events.EventHeader{Op: events.EvtKindMessage}
 	for {
 		select {
-		case evt := <-evts:
+		case evt, ok := <-evts:
+			if !ok {
+				// event manager shut down
+				return nil
+			}
+
 			wc, err := conn.NextWriter(websocket.BinaryMessage)
 			if err != nil {
 				return err
 			}
 
-			var obj lexutil.CBOR
-
-			switch {
-			case evt.Error != nil:
-				header.Op = events.EvtKindErrorFrame
-				obj = evt.Error
-			case evt.LabelInfo != nil:
-				header.MsgType = "#info"
-				obj = evt.LabelInfo
-			case evt.LabelLabels != nil:
-				header.MsgType = "#labels"
-				obj = evt.LabelLabels
-			default:
-				return fmt.Errorf("unrecognized event kind")
-			}
-
-			if err := header.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write header: %w", err)
-			}
-
-			if err := obj.MarshalCBOR(wc); err != nil {
-				return fmt.Errorf("failed to write event: %w", err)
+			if err := evt.MarshalFrames(wc); err != nil {
+				return err
 			}
 
 			if err := wc.Close(); err != nil {
@@ -384,7 +384,7 @@ func SetupBGS(host string, didr plc.PLCClient) (*testBGS, error) {
 
 	evtman := events.NewEventManager(dbpersist)
 
-	go evtman.Run()
+	go evtman.Run(context.Background())
 
 	ix, err := indexer.NewIndexer(maindb, notifman, evtman, didr, repoman, true, true)
 	if err != nil {